@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const usage = `usage: buidl [flags] <command> [args]
+
+commands:
+  new [-bits n] [-json]          generate a mnemonic
+  validate [-name n] [-json] [words]
+                                 check a mnemonic
+  seed [-ask] [-json] [words]
+                                 print the hex seed of a mnemonic
+  entropy [-json] [words]        print the hex entropy of a mnemonic
+  qr [-o file] [words]           write a PNG QR code of a mnemonic
+  unqr [-json] <file>            print the mnemonic of a PNG QR code
+  split [-k k] [-n n] [-json] [words]
+                                 split a mnemonic into n shares, any k of which
+                                 recombine into it
+  recombine [-json] [shares]     print the mnemonic of shares, one per line as
+                                 split prints them
+  repl                           look up words, indices and mnemonics typed in
+                                 one at a time
+
+without words, the mnemonic is read from stdin. The passphrase of seed is empty
+unless given, by $RU_MNEMONIC_PASSPHRASE or typed at the prompt of -ask; it's
+never taken from the command line, where shell history and ps would show it.
+
+-json, before the command or after it, prints a line of JSON instead, and errors
+as {"error": "..."}.
+
+
+flags:
+`
+
+// commands are the subcommands of buidl, run with the wordlist and their args.
+var commands = map[string]func(w *Words, args []string) error{
+	"new": newCmd,
+	"validate": validateCmd,
+	"seed": seedCmd,
+	"entropy": entropyCmd,
+	"qr": qrCmd,
+	"unqr": unqrCmd,
+	"split": splitCmd,
+	"recombine": recombineCmd,
+	"repl": replCmd,
+}
+
+// jsonOut is set by -json, given to buidl or to its command.
+var jsonOut bool
+
+// jsonFlag adds -json to the flags of a command.
+func jsonFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&jsonOut, "json", jsonOut, "print JSON")
+}
+
+// output prints v as a line of JSON under -json, and text otherwise.
+func output(text string, v interface{}) error {
+	if !jsonOut {
+		fmt.Println(text)
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+type mnemonicJSON struct{
+	Mnemonic string `json:"mnemonic"`
+}
+
+func newCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	bits := fs.Int("bits", 128, "`bits` of entropy, 128 to 256 in multiples of 32")
+	jsonFlag(fs)
+	fs.Parse(args)
+	m, err := w.GenerateMnemonic(*bits)
+	if err != nil {
+		return err
+	}
+	s := strings.Join(m.Words(), " ")
+	return output(s, mnemonicJSON{s})
+}
+
+// parse returns the mnemonic of the words in args, given as one argument or many,
+// or read from stdin when there are none.
+func parse(w *Words, args []string) (*Mnemonic, error) {
+	return parseNamed(w, "", args)
+}
+
+func parseNamed(w *Words, name string, args []string) (*Mnemonic, error) {
+	s := strings.Join(args, " ")
+	if len(args) == 0 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	// Pasted mnemonics are often spaced irregularly, or span lines.
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no mnemonic: give its words as arguments or on stdin")
+	}
+	return w.NewNamedMnemonic(name, strings.Join(fields, " "))
+}
+
+// strongBits is the entropy of the longest mnemonics, 24 words; shorter ones are
+// valid but reported weak, for seeds meant to be kept for a long time.
+const strongBits = 256
+
+// validation is what validate reports of a mnemonic under -json; a mnemonic that
+// isn't valid is an error instead.
+type validation struct{
+	Valid bool `json:"valid"`
+	Name string `json:"name"`
+	Words int `json:"words"`
+	EntropyBits int `json:"entropy_bits"`
+	ChecksumOK bool `json:"checksum_ok"`
+	Weak bool `json:"weak"`
+}
+
+func validateCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	name := fs.String("name", "", "`name` of the mnemonic")
+	jsonFlag(fs)
+	fs.Parse(args)
+	m, err := parseNamed(w, *name, fs.Args())
+	if err != nil {
+		return err
+	}
+	v := validation{
+		Valid: true,
+		Name: m.Name,
+		Words: len(m.Words()),
+		EntropyBits: m.Bits,
+		ChecksumOK: true,
+		Weak: m.Bits < strongBits,
+	}
+	verdict := "valid"
+	if v.Weak {
+		verdict = "valid but weak"
+	}
+	text := fmt.Sprintf("%s\n%s: %d words, %d bits of entropy, checksum ok", m.String(), verdict, v.Words, v.EntropyBits)
+	return output(text, v)
+}
+
+// passphraseEnv names the environment variable of the BIP39 passphrase, so it can
+// be kept out of the command line, shell history and ps.
+const passphraseEnv = "RU_MNEMONIC_PASSPHRASE"
+
+func seedCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	ask := fs.Bool("ask", false, "prompt for the BIP39 passphrase on the terminal, without echo, instead of reading $"+passphraseEnv)
+	jsonFlag(fs)
+	fs.Parse(args)
+	m, err := parse(w, fs.Args())
+	if err != nil {
+		return err
+	}
+	// The environment is only read now, so the passphrase is never a flag's
+	// default that -h would print.
+	passphrase := os.Getenv(passphraseEnv)
+	if *ask {
+		passphrase, err = askPassphrase()
+		if err != nil {
+			return err
+		}
+	}
+	seed := hex.EncodeToString(m.Seed(passphrase))
+	return output(seed, struct{
+		Seed string `json:"seed"`
+	}{seed})
+}
+
+// askPassphrase prompts for the passphrase on the terminal, which is opened itself
+// as stdin may have been the mnemonic.
+func askPassphrase() (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to ask for the passphrase: %v", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, "passphrase: ")
+	b, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func entropyCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("entropy", flag.ExitOnError)
+	jsonFlag(fs)
+	fs.Parse(args)
+	m, err := parse(w, fs.Args())
+	if err != nil {
+		return err
+	}
+	entropy, err := m.Entropy()
+	if err != nil {
+		return err
+	}
+	h := hex.EncodeToString(entropy)
+	return output(h, struct{
+		Entropy string `json:"entropy"`
+	}{h})
+}
+
+func qrCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("qr", flag.ExitOnError)
+	out := fs.String("o", "", "write the PNG to `file` instead of stdout")
+	fs.Parse(args)
+	m, err := parse(w, fs.Args())
+	if err != nil {
+		return err
+	}
+	b, err := m.QR()
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		return ioutil.WriteFile(*out, b, 0600)
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+func unqrCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("unqr", flag.ExitOnError)
+	jsonFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("unqr takes one PNG file")
+	}
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := w.FromQR(b)
+	if err != nil {
+		return err
+	}
+	s := strings.Join(m.Words(), " ")
+	return output(s, mnemonicJSON{s})
+}
+
+func splitCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	k := fs.Int("k", 2, "`shares` it takes to recombine")
+	n := fs.Int("n", 3, "`shares` to split into")
+	jsonFlag(fs)
+	fs.Parse(args)
+	m, err := parse(w, fs.Args())
+	if err != nil {
+		return err
+	}
+	shares, err := m.Split(*k, *n)
+	if err != nil {
+		return err
+	}
+	type shareJSON struct{
+		X byte `json:"x"`
+		Mnemonic string `json:"mnemonic"`
+	}
+	lines, js := []string{}, []shareJSON{}
+	for _, s := range shares {
+		sm, err := s.Mnemonic(w)
+		if err != nil {
+			return err
+		}
+		words := strings.Join(sm.Words(), " ")
+		lines = append(lines, fmt.Sprintf("%d: %s", s.X, words))
+		js = append(js, shareJSON{s.X, words})
+	}
+	return output(strings.Join(lines, "\n"), struct{
+		Shares []shareJSON `json:"shares"`
+	}{js})
+}
+
+// recombineCmd reads shares a line each, from its args if any and stdin if not.
+func recombineCmd(w *Words, args []string) error {
+	fs := flag.NewFlagSet("recombine", flag.ExitOnError)
+	jsonFlag(fs)
+	fs.Parse(args)
+	lines := fs.Args()
+	if len(lines) == 0 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		lines = strings.Split(string(b), "\n")
+	}
+	shares := []Share{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s, err := w.ParseShare(line)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, s)
+	}
+	m, err := w.Recombine(shares)
+	if err != nil {
+		return err
+	}
+	s := strings.Join(m.Words(), " ")
+	return output(s, mnemonicJSON{s})
+}
+
+func main() {
+	wordsPath := flag.String("words", "", "JSON `file` of a custom wordlist instead of the embedded one")
+	lang := flag.String("lang", string(English), "`language` of the wordlist")
+	complete := flag.Bool("complete", false, "accept the first four letters of words")
+	minDistinct := flag.Int("min-distinct", 0, "warn of mnemonics with fewer than `n` distinct words, 0 for none")
+	strict := flag.Bool("strict", false, "refuse mnemonics with fewer than -min-distinct distinct words")
+	flag.BoolVar(&jsonOut, "json", false, "print JSON, errors included")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "buidl: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	words, err := Get(Language(*lang))
+	if *wordsPath != "" {
+		words, err = Load(Language(*lang), *wordsPath)
+	}
+	if err == nil {
+		words.AutoComplete = *complete
+		words.MinDistinct = *minDistinct
+		words.Strict = *strict
+		err = cmd(words, flag.Args()[1:])
+	}
+	if err != nil && jsonOut {
+		b, _ := json.Marshal(struct{
+			Error string `json:"error"`
+		}{err.Error()})
+		fmt.Println(string(b))
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "buidl: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// qrSize is the width and height in pixels of the QR codes of mnemonics.
+const qrSize = 512
+
+// QR returns a PNG of a QR code of the mnemonic's words, joined by spaces.
+func (m *Mnemonic) QR() ([]byte, error) {
+	hints := map[gozxing.EncodeHintType]interface{}{
+		gozxing.EncodeHintType_CHARACTER_SET: "UTF-8",
+		gozxing.EncodeHintType_ERROR_CORRECTION: "M",
+	}
+	bm, err := qrcode.NewQRCodeWriter().Encode(strings.Join(m.Words(), " "), gozxing.BarcodeFormat_QR_CODE, qrSize, qrSize, hints)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewGray(image.Rect(0, 0, bm.GetWidth(), bm.GetHeight()))
+	for y := 0; y < bm.GetHeight(); y++ {
+		for x := 0; x < bm.GetWidth(); x++ {
+			c := color.White
+			if bm.Get(x, y) {
+				c = color.Black
+			}
+			img.Set(x, y, c)
+		}
+	}
+	b := &bytes.Buffer{}
+	err = png.Encode(b, img)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// FromQR returns the mnemonic in the QR code of the PNG b, checked as NewMnemonic
+// checks it, so a word scanned wrong is caught.
+func (w *Words) FromQR(b []byte) (*Mnemonic, error) {
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil, err
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_CHARACTER_SET: "UTF-8",
+	}
+	res, err := qrcode.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return nil, fmt.Errorf("no QR code found: %v", err)
+	}
+	return w.NewMnemonic(strings.Join(strings.Fields(res.GetText()), " "))
+}
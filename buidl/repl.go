@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const replHelp = `type
+  a word          to see its index, or the words it's the start of
+  a number        to see the word of that index
+  many words      to validate them as a mnemonic
+  ?               for this help
+and end with EOF, ctrl-D.`
+
+// replCmd reads lines of stdin until EOF, answering each as replHelp says; a line
+// it can't answer is reported and the next read, so one typo doesn't end the
+// session.
+func replCmd(w *Words, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("repl takes no arguments")
+	}
+	return repl(w, os.Stdin, os.Stdout, term.IsTerminal(int(os.Stdin.Fd())))
+}
+
+// repl answers the lines of r on out, prompting for each if prompt.
+func repl(w *Words, r io.Reader, out io.Writer, prompt bool) error {
+	scanner := bufio.NewScanner(r)
+	for {
+		if prompt {
+			fmt.Fprint(out, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		answer, err := replLine(w, scanner.Text())
+		if err != nil {
+			answer = "error: " + err.Error()
+		}
+		if answer != "" {
+			fmt.Fprintln(out, answer)
+		}
+	}
+	if prompt {
+		fmt.Fprintln(out)
+	}
+	return scanner.Err()
+}
+
+// replLine is the answer to one line of the repl.
+func replLine(w *Words, line string) (string, error) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return "", nil
+	case len(fields) == 1 && fields[0] == "?":
+		return replHelp, nil
+	case len(fields) > 1:
+		m, err := w.NewMnemonic(strings.Join(fields, " "))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("valid: %d words, %d bits of entropy, checksum ok", len(m.Words()), m.Bits), nil
+	}
+	if n, err := strconv.Atoi(fields[0]); err == nil {
+		if n < 0 || n >= w.Len() {
+			return "", fmt.Errorf("no word %d, the %s wordlist has 0 to %d", n, w.Language, w.Len()-1)
+		}
+		return string(w.Number(n)), nil
+	}
+	if i, ok := w.Index(fields[0]); ok {
+		return strconv.Itoa(i), nil
+	}
+	matches, err := w.Complete(fields[0])
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, k := range matches {
+		i, _ := w.Index(string(k))
+		lines = append(lines, fmt.Sprintf("%d %s", i, k))
+	}
+	return strings.Join(lines, "\n"), nil
+}
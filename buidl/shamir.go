@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A Share is one of the shares Split makes of a mnemonic's entropy: the value Y at
+// X of a random polynomial over GF(2^8) for each byte, whose value at 0 is the
+// byte of the entropy. Any k shares of a split by k determine the polynomials and
+// so the entropy; fewer leave every entropy just as likely.
+//
+// Y is as long as the entropy, so a share can be written down as the mnemonic of Y
+// along with X, see Mnemonic and ShareOf. Its checksum only catches typos, it's
+// not a check of the share belonging to the split.
+type Share struct{
+	X byte
+	Y []byte
+}
+
+// Split splits the entropy of m into n shares, any k of which recombine into it;
+// k is 2 to n, and n at most 255.
+func (m *Mnemonic) Split(k, n int) ([]Share, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("bad split of %d of %d shares, want 2 to 255 shares and 2 to all of them to recombine", k, n)
+	}
+	entropy, err := m.Entropy()
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{X: byte(i + 1), Y: make([]byte, len(entropy))}
+	}
+	coeffs := make([]byte, k)
+	for b, secret := range entropy {
+		coeffs[0] = secret
+		_, err := io.ReadFull(rand.Reader, coeffs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i].Y[b] = evalPoly(coeffs, shares[i].X)
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// Recombine returns the mnemonic whose entropy the shares are of, given at least as
+// many of one split as it was split by. Fewer, or shares of different splits,
+// recombine into some other entropy without error, which only the mnemonic being
+// unfamiliar tells.
+func (w *Words) Recombine(shares []Share) (*Mnemonic, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%d shares, want at least 2", len(shares))
+	}
+	seen := map[byte]bool{}
+	for _, s := range shares {
+		if s.X == 0 {
+			return nil, fmt.Errorf("share 0 holds the secret itself, it's never made")
+		}
+		if seen[s.X] {
+			return nil, fmt.Errorf("share %d given twice", s.X)
+		}
+		seen[s.X] = true
+		if len(s.Y) != len(shares[0].Y) {
+			return nil, fmt.Errorf("share %d of %d bytes, share %d of %d", s.X, len(s.Y), shares[0].X, len(shares[0].Y))
+		}
+	}
+	// Lagrange interpolation at 0: the entropy is the sum of each Y weighted by
+	// the product of x/(x-X) over the other shares' x, where - is +.
+	entropy := make([]byte, len(shares[0].Y))
+	for i, s := range shares {
+		weight := byte(1)
+		for j, o := range shares {
+			if i != j {
+				weight = gfMul(weight, gfMul(o.X, gfInv(o.X^s.X)))
+			}
+		}
+		for b := range entropy {
+			entropy[b] ^= gfMul(weight, s.Y[b])
+		}
+	}
+	return w.FromEntropy(entropy)
+}
+
+// Mnemonic returns the mnemonic of the share's Y, named after its X, which is to be
+// written down with it.
+func (s Share) Mnemonic(w *Words) (*Mnemonic, error) {
+	m, err := w.FromEntropy(s.Y)
+	if err != nil {
+		return nil, err
+	}
+	m.Name = "share " + strconv.Itoa(int(s.X))
+	return m, nil
+}
+
+// ShareOf returns the share of X x whose Y is the entropy of m, as written down
+// from Share.Mnemonic.
+func ShareOf(x int, m *Mnemonic) (Share, error) {
+	if x < 1 || x > 255 {
+		return Share{}, fmt.Errorf("bad share number %d, want 1 to 255", x)
+	}
+	y, err := m.Entropy()
+	if err != nil {
+		return Share{}, err
+	}
+	return Share{X: byte(x), Y: y}, nil
+}
+
+// ParseShare parses a share written as its X, a colon and the words of its
+// mnemonic, as the split command prints them.
+func (w *Words) ParseShare(s string) (Share, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Share{}, fmt.Errorf("no share number before a colon in %q", s)
+	}
+	x, err := strconv.Atoi(strings.TrimSpace(s[:i]))
+	if err != nil {
+		return Share{}, fmt.Errorf("bad share number %q", s[:i])
+	}
+	m, err := w.NewMnemonic(strings.Join(strings.Fields(s[i+1:]), " "))
+	if err != nil {
+		return Share{}, fmt.Errorf("share %d: %v", x, err)
+	}
+	return ShareOf(x, m)
+}
+
+// evalPoly is the value at x of the polynomial of coeffs, lowest first.
+func evalPoly(coeffs []byte, x byte) byte {
+	y := byte(0)
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x + 1, as AES does; it
+// takes the same steps whatever a and b are, as they're of secrets.
+func gfMul(a, b byte) byte {
+	p := byte(0)
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ carry&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv is the inverse of a in GF(2^8), a^254; the inverse of 0 is 0.
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 254; i++ {
+		r = gfMul(r, a)
+	}
+	return r
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	// These are the examples of FIPS-197, the AES specification.
+	vectors := []struct{
+		a, b, product byte
+	}{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x02, 0xae},
+		{0x57, 0x04, 0x47},
+		{0x57, 0x08, 0x8e},
+		{0x57, 0x10, 0x07},
+	}
+	for _, v := range vectors {
+		if p := gfMul(v.a, v.b); p != v.product {
+			t.Errorf("gfMul(%#02x, %#02x) = %#02x, want %#02x", v.a, v.b, p, v.product)
+		}
+		if p := gfMul(v.b, v.a); p != v.product {
+			t.Errorf("gfMul(%#02x, %#02x) = %#02x, want %#02x", v.b, v.a, p, v.product)
+		}
+	}
+	if i := gfInv(0x53); i != 0xca {
+		t.Errorf("gfInv(0x53) = %#02x, want 0xca", i)
+	}
+	if i := gfInv(0); i != 0 {
+		t.Errorf("gfInv(0) = %#02x, want 0", i)
+	}
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%#02x times its inverse is %#02x", a, p)
+		}
+	}
+}
+
+// mnemonic returns the mnemonic of the words, failing the test if it isn't one.
+func mnemonic(t *testing.T, w *Words, words string) *Mnemonic {
+	t.Helper()
+	m, err := w.NewMnemonic(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRecombineVector(t *testing.T) {
+	w := english(t)
+	// The shares of zero entropy by the polynomial x have Y all X.
+	shares := []Share{
+		{X: 1, Y: bytes.Repeat([]byte{1}, 16)},
+		{X: 2, Y: bytes.Repeat([]byte{2}, 16)},
+	}
+	m, err := w.Recombine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := repeat("abandon", 11, "about"); strings.Join(m.Words(), " ") != want {
+		t.Errorf("recombined %q, want %q", m.Words(), want)
+	}
+	// These are of 0x53 + 0xca x, whose value at 0x53 is 0x53 + 1 as 0xca is the
+	// inverse of 0x53.
+	shares = []Share{
+		{X: 1, Y: bytes.Repeat([]byte{0x53 ^ 0xca}, 16)},
+		{X: 0x53, Y: bytes.Repeat([]byte{0x53 ^ 1}, 16)},
+	}
+	m, err = w.Recombine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entropy, err := m.Entropy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{0x53}, 16); !bytes.Equal(entropy, want) {
+		t.Errorf("recombined %x, want %x", entropy, want)
+	}
+}
+
+// subsets calls f with every subset of k of the shares.
+func subsets(shares []Share, k int, f func([]Share)) {
+	var pick func(from int, picked []Share)
+	pick = func(from int, picked []Share) {
+		if len(picked) == k {
+			f(picked)
+			return
+		}
+		for i := from; i < len(shares); i++ {
+			pick(i+1, append(picked[:len(picked):len(picked)], shares[i]))
+		}
+	}
+	pick(0, nil)
+}
+
+func TestSplitRecombine(t *testing.T) {
+	w := english(t)
+	m := mnemonic(t, w, "letter advice cage absurd amount doctor acoustic avoid letter advice cage above")
+	want, err := m.Entropy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ k, n int }{{2, 2}, {2, 3}, {3, 5}, {5, 5}} {
+		shares, err := m.Split(c.k, c.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != c.n {
+			t.Fatalf("%d of %d: %d shares", c.k, c.n, len(shares))
+		}
+		for size := c.k; size <= c.n; size++ {
+			subsets(shares, size, func(some []Share) {
+				r, err := w.Recombine(some)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := r.Entropy()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%d of %d: %d shares recombined into %x, want %x", c.k, c.n, size, got, want)
+				}
+			})
+		}
+		if c.k > 2 {
+			subsets(shares, c.k-1, func(some []Share) {
+				r, err := w.Recombine(some)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ := r.Entropy()
+				if bytes.Equal(got, want) {
+					t.Errorf("%d of %d: %d shares recombined into the entropy", c.k, c.n, len(some))
+				}
+			})
+		}
+	}
+}
+
+// Fewer shares than the split was by reveal nothing: a share of a split by 2 is as
+// likely of any secret byte, there being one polynomial through it for each.
+func TestShareRevealsNothing(t *testing.T) {
+	for x := 1; x < 256; x += 17 {
+		for _, y := range []byte{0, 0x53, 0xff} {
+			for secret := 0; secret < 256; secret++ {
+				n := 0
+				for c := 0; c < 256; c++ {
+					if evalPoly([]byte{byte(secret), byte(c)}, byte(x)) == y {
+						n++
+					}
+				}
+				if n != 1 {
+					t.Fatalf("share %d of %#02x: %d polynomials of secret %#02x, want 1", x, y, n, secret)
+				}
+			}
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	w := english(t)
+	m := mnemonic(t, w, repeat("abandon", 11, "about"))
+	for _, c := range []struct{ k, n int }{{1, 3}, {0, 0}, {4, 3}, {2, 256}} {
+		if _, err := m.Split(c.k, c.n); err == nil {
+			t.Errorf("split of %d of %d: no error", c.k, c.n)
+		}
+	}
+	shares, err := m.Split(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := [][]Share{
+		shares[:1],
+		{shares[0], shares[0]},
+		{shares[0], {X: 0, Y: shares[1].Y}},
+		{shares[0], {X: 2, Y: shares[1].Y[:4]}},
+	}
+	for _, some := range bad {
+		if _, err := w.Recombine(some); err == nil {
+			t.Errorf("recombined %v", some)
+		}
+	}
+}
+
+func TestShareWords(t *testing.T) {
+	w := english(t)
+	m := mnemonic(t, w, repeat("zoo", 23, "vote"))
+	shares, err := m.Split(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := []Share{}
+	for _, s := range shares {
+		sm, err := s.Mnemonic(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sm.Name != fmt.Sprintf("share %d", s.X) || sm.Bits != 256 {
+			t.Errorf("share %d: name %q of %d bits", s.X, sm.Name, sm.Bits)
+		}
+		// As the split command prints them, and as they might be typed back.
+		p, err := w.ParseShare(fmt.Sprintf(" %d :  %s ", s.X, strings.Join(sm.Words(), "  ")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.X != s.X || !bytes.Equal(p.Y, s.Y) {
+			t.Errorf("share %d %x parsed as %d %x", s.X, s.Y, p.X, p.Y)
+		}
+		parsed = append(parsed, p)
+	}
+	r, err := w.Recombine(parsed[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Words(), m.Words()) {
+		t.Errorf("recombined %q, want %q", r.Words(), m.Words())
+	}
+
+	for _, s := range []string{
+		repeat("abandon", 11, "about"),
+		"x: " + repeat("abandon", 11, "about"),
+		"0: " + repeat("abandon", 11, "about"),
+		"1: " + repeat("abandon", 12, ""),
+	} {
+		if _, err := w.ParseShare(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
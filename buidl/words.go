@@ -1,91 +1,438 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 )
 
 type (
 	Word string
-	Words map[Word]int
+	// Language names a BIP39 wordlist
+	Language string
+	Words struct{
+		Language Language
+		// AutoComplete has NewMnemonic accept the unique prefixes of words
+		AutoComplete bool
+		// MinDistinct has NewMnemonic warn of mnemonics with fewer distinct
+		// words, as placeholder seeds like twelve "abandon"s have, or refuse
+		// them if Strict; 0 checks nothing, as valid seeds may repeat words
+		MinDistinct int
+		Strict bool
+		words map[Word]int
+		// indices is the reverse of words, built along with it as a Words
+		// is never changed once read
+		indices Indices
+	}
 	Indices map[int]Word
 	Mnemonic struct{
 		words []Word
+		indices []int
 		Name string
+		Language Language
+		// Bits is the length of the entropy the words encode
+		Bits int
 	}
 )
 
 func (m *Mnemonic) String() string {
+	return fmt.Sprintf("Mnemonic{\n  Name: %q,\n  Language: %q,\n  Bits: %d,\n  words: %q\n}", m.Name, m.Language, m.Bits, strings.Join(m.Words(), " "))
+}
+
+// Words returns the words of the mnemonic.
+func (m *Mnemonic) Words() []string {
 	ws := make([]string, len(m.words), len(m.words))
 	for i, w := range m.words {
 		ws[i] = string(w)
 	}
-	return fmt.Sprintf("Mnemonic{\n  Name: %q,\n  words: %q\n}", m.Name, strings.Join(ws, " "))
+	return ws
+}
+
+// Seed returns the 64 byte BIP39 seed of the mnemonic and passphrase, its words
+// stretched by PBKDF2-HMAC-SHA512 with 2048 iterations salted by "mnemonic" and the
+// passphrase; both are NFKD normalized first, as words with accents can be
+// written in more than one way. The passphrase, the "25th word", is usually empty,
+// and any other gives a different seed of the same words.
+func (m *Mnemonic) Seed(passphrase string) []byte {
+	sentence := norm.NFKD.String(strings.Join(m.Words(), " "))
+	salt := norm.NFKD.String("mnemonic" + passphrase)
+	return pbkdf2.Key([]byte(sentence), []byte(salt), 2048, 64, sha512.New)
 }
 
+// entropyBits maps the number of words of a mnemonic to the length of its entropy,
+// every word is 11 bits and the checksum is 1 bit for every 32 bits of entropy.
+var entropyBits = map[int]int{
+	12: 128,
+	15: 160,
+	18: 192,
+	21: 224,
+	24: 256,
+}
+
+// defaultName is the Name of mnemonics that aren't given one.
+const defaultName = "mnemonic0"
+
 // NewMnemonic returns a list of mnemonic words chosen from the list of all Words.
 func (w *Words) NewMnemonic(mnemonic string) (*Mnemonic, error) {
+	return w.NewNamedMnemonic("", mnemonic)
+}
+
+// NewNamedMnemonic is NewMnemonic with the Name of the mnemonic, defaultName if
+// it's "".
+func (w *Words) NewNamedMnemonic(name, mnemonic string) (*Mnemonic, error) {
+	if name == "" {
+		name = defaultName
+	}
 	parts := strings.Split(mnemonic, " ")
-	if len(parts) != 12 {
-		return nil, fmt.Errorf("bad number of words: %d", len(parts))
+	bits, ok := entropyBits[len(parts)]
+	if !ok {
+		return nil, fmt.Errorf("bad number of words: %d, want 12, 15, 18, 21 or 24", len(parts))
 	}
 	ws := make([]Word, len(parts), len(parts))
+	indices := make([]int, len(parts), len(parts))
+	unknown := []string{}
 	for i, p := range parts {
-		fmt.Printf("[%d] %q: %d\n", i+1, p, w.Index(p))
+		// the wordlists are lowercase and NFKD normalized, the mnemonic keeps
+		// the words as they're listed however they were typed
+		p = norm.NFKD.String(strings.ToLower(p))
+		idx, ok := w.Index(p)
+		if !ok && w.AutoComplete {
+			completed, err := w.Complete(p)
+			if err == nil && len(completed) == 1 {
+				p = string(completed[0])
+				idx, ok = w.Index(p)
+			}
+		}
+		if !ok {
+			unknown = append(unknown, fmt.Sprintf("[%d] %q", i+1, p))
+			continue
+		}
 		ws[i] = Word(p)
+		indices[i] = idx
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("words not in the wordlist: %s", strings.Join(unknown, ", "))
+	}
+	_, err := decode(indices)
+	if err != nil {
+		return nil, err
+	}
+	if n := distinct(ws); n < w.MinDistinct {
+		if w.Strict {
+			return nil, fmt.Errorf("only %d distinct words of %d, is it an example seed?", n, len(ws))
+		}
+		fmt.Fprintf(os.Stderr, "warning: only %d distinct words of %d, is it an example seed?\n", n, len(ws))
 	}
 	return &Mnemonic{
 		words: ws,
-		Name: "mnemonic0",
+		indices: indices,
+		Name: name,
+		Language: w.Language,
+		Bits: bits,
 	}, nil
 }
 
-func (w *Words) Indices() Indices {
-	result := Indices{}
-	for k, v := range *w {
-		result[v] = k
+// distinct counts the different words of ws.
+func distinct(ws []Word) int {
+	seen := map[Word]bool{}
+	for _, w := range ws {
+		seen[w] = true
+	}
+	return len(seen)
+}
+
+// GenerateMnemonic returns a new mnemonic encoding bits of random entropy, which
+// is 128 to 256 bits in multiples of 32.
+func (w *Words) GenerateMnemonic(bits int) (*Mnemonic, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return nil, fmt.Errorf("bad entropy length: %d bits, want 128 to 256 in multiples of 32", bits)
+	}
+	entropy := make([]byte, bits/8, bits/8)
+	_, err := io.ReadFull(rand.Reader, entropy)
+	if err != nil {
+		return nil, err
+	}
+	return w.FromEntropy(entropy)
+}
+
+// FromEntropy returns the mnemonic encoding entropy, which is 16 to 32 bytes in
+// multiples of 4.
+func (w *Words) FromEntropy(entropy []byte) (*Mnemonic, error) {
+	bits := len(entropy) * 8
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return nil, fmt.Errorf("bad entropy length: %d bits, want 128 to 256 in multiples of 32", bits)
+	}
+	indices := encode(entropy)
+	ws := make([]Word, len(indices), len(indices))
+	for i, idx := range indices {
+		ws[i] = w.Number(idx)
+	}
+	return &Mnemonic{
+		words: ws,
+		indices: indices,
+		Name: defaultName,
+		Language: w.Language,
+		Bits: bits,
+	}, nil
+}
+
+// Entropy returns the entropy the mnemonic encodes, checking its checksum.
+func (m *Mnemonic) Entropy() ([]byte, error) {
+	return decode(m.indices)
+}
+
+// Validate checks the mnemonic again against the wordlist w, however it was made:
+// that it has 12 to 24 words in multiples of 3, that each is in w at the index the
+// mnemonic has for it, that Bits is what that many words encode, and the checksum.
+// It returns the first check that fails.
+func (m *Mnemonic) Validate(w *Words) error {
+	bits, ok := entropyBits[len(m.words)]
+	if !ok {
+		return fmt.Errorf("bad number of words: %d, want 12, 15, 18, 21 or 24", len(m.words))
+	}
+	if len(m.indices) != len(m.words) {
+		return fmt.Errorf("%d indices of %d words", len(m.indices), len(m.words))
+	}
+	if m.Language != "" && w.Language != "" && m.Language != w.Language {
+		return fmt.Errorf("mnemonic in %s, wordlist in %s", m.Language, w.Language)
+	}
+	for i, word := range m.words {
+		idx, ok := w.Index(string(word))
+		if !ok {
+			return fmt.Errorf("word not in the wordlist: [%d] %q", i+1, word)
+		}
+		if idx != m.indices[i] {
+			return fmt.Errorf("word [%d] %q is number %d of the wordlist, not %d", i+1, word, idx, m.indices[i])
+		}
+	}
+	if m.Bits != bits {
+		return fmt.Errorf("%d words encode %d bits, not %d", len(m.words), bits, m.Bits)
+	}
+	_, err := decode(m.indices)
+	return err
+}
+
+// encode appends the BIP39 checksum to entropy, the first len(entropy)/32 bits of
+// its SHA-256, and splits the result into the 11 bit indices of its words.
+func encode(entropy []byte) []int {
+	sum := sha256.Sum256(entropy)
+	b := append(append([]byte{}, entropy...), sum[0])
+	nbits := len(entropy)*8 + len(entropy)*8/32
+	indices := make([]int, nbits/11, nbits/11)
+	for bit := 0; bit < nbits; bit++ {
+		if b[bit/8]&(1<<(7-bit%8)) != 0 {
+			indices[bit/11] |= 1 << (10 - bit%11)
+		}
+	}
+	return indices
+}
+
+// decode returns the entropy of the mnemonic with the word indices, checking its
+// BIP39 checksum; each index is 11 bits of the entropy followed by its checksum,
+// which is the first len(entropy)/32 bits of the SHA-256 of the entropy.
+func decode(indices []int) ([]byte, error) {
+	if _, ok := entropyBits[len(indices)]; !ok {
+		return nil, fmt.Errorf("bad number of words: %d, want 12, 15, 18, 21 or 24", len(indices))
+	}
+	nbits := len(indices) * 11
+	ncs := nbits / 33
+	b := make([]byte, (nbits+7)/8, (nbits+7)/8)
+	for i, idx := range indices {
+		for j := 0; j < 11; j++ {
+			if idx&(1<<(10-j)) != 0 {
+				bit := i*11 + j
+				b[bit/8] |= 1 << (7 - bit%8)
+			}
+		}
+	}
+	entropy := b[:(nbits-ncs)/8]
+	sum := sha256.Sum256(entropy)
+	mask := byte(0xff << (8 - ncs))
+	got := b[len(entropy)] & mask
+	want := sum[0] & mask
+	if got != want {
+		return nil, fmt.Errorf("bad checksum of mnemonic: last word encodes %0*b, entropy hashes to %0*b",
+			ncs, got>>(8-ncs), ncs, want>>(8-ncs))
+	}
+	return entropy, nil
+}
+
+// prefixLen is how many letters of a word identify it, BIP39 wordlists have no
+// two words starting with the same prefixLen letters.
+const prefixLen = 4
+
+// Complete returns the words starting with prefix, in order; it's an error for a
+// prefix of at least prefixLen letters to be the start of more than one word.
+func (w *Words) Complete(prefix string) ([]Word, error) {
+	prefix = norm.NFKD.String(strings.ToLower(prefix))
+	result := []Word{}
+	for k := range w.words {
+		if strings.HasPrefix(string(k), prefix) {
+			result = append(result, k)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return w.words[result[i]] < w.words[result[j]]
+	})
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no word starts with %q", prefix)
+	}
+	if len(result) > 1 && utf8.RuneCountInString(prefix) >= prefixLen {
+		return nil, fmt.Errorf("ambiguous prefix %q of %d words, the %s wordlist isn't BIP39", prefix, len(result), w.Language)
 	}
-	return result
+	return result, nil
+}
+
+func (w *Words) Indices() Indices {
+	return w.indices
 }
 
 func (w *Words) Number(n int) Word {
-	indices := w.Indices()
-	return indices[n]
+	return w.indices[n]
 }
 
-func (w *Words) Index(k string) int {
-	return (*w)[Word(k)]
+// Index returns the index of the word k, and whether it's in the wordlist at all;
+// the index of an unknown word is 0, the same as the first word.
+func (w *Words) Index(k string) (int, bool) {
+	i, ok := w.words[Word(k)]
+	return i, ok
+}
+
+// Len returns the number of words in the wordlist.
+func (w *Words) Len() int {
+	return len(w.words)
+}
+
+// Diff returns how other differs from w, in order of the words' indices: "-word"
+// for each word only w has, "+word" for each only other has, and "~word" for each
+// both have at different indices, which changes what the word encodes just as much.
+// Mnemonics of one are only the same mnemonics in the other when it's empty.
+func (w *Words) Diff(other *Words) []string {
+	diff := []string{}
+	for i := 0; i < len(w.indices); i++ {
+		word := w.indices[i]
+		j, ok := other.words[word]
+		switch {
+		case !ok:
+			diff = append(diff, "-"+string(word))
+		case i != j:
+			diff = append(diff, "~"+string(word))
+		}
+	}
+	for j := 0; j < len(other.indices); j++ {
+		word := other.indices[j]
+		if _, ok := w.words[word]; !ok {
+			diff = append(diff, "+"+string(word))
+		}
+	}
+	return diff
+}
+
+const (
+	English Language = "english"
+	Spanish Language = "spanish"
+)
+
+// wordlists are the BIP39 wordlists, embedded so the binary runs from anywhere
+//go:embed buidl/words.json buidl/words_spanish.json
+var wordlists embed.FS
+
+// wordlistFiles maps each language to its file in wordlists.
+var wordlistFiles = map[Language]string{
+	English: "buidl/words.json",
+	Spanish: "buidl/words_spanish.json",
 }
 
-func Get() (*Words, error) {
-	f, err := os.Open("buidl/words.json")
+// wordlistSums are the SHA-256 sums of the canonical wordlists, of the text files
+// of BIP39 with a word per line.
+var wordlistSums = map[Language]string{
+	English: "2f5eed53a4727b4bf8880d8f3f199efc90e58503646d9ff8eff3a2ed3b24dbda",
+	Spanish: "46846a5a0139d1e3cb77293e521c2865f7bcdb82c44e8d0a06a2cd0ecba48c0b",
+}
+
+// languageTags are the languages the wordlists are sorted in, by their rules.
+var languageTags = map[Language]language.Tag{
+	English: language.English,
+	Spanish: language.Spanish,
+}
+
+// Get returns the embedded wordlist of the language.
+func Get(lang Language) (*Words, error) {
+	name, ok := wordlistFiles[lang]
+	if !ok {
+		return nil, fmt.Errorf("no wordlist for language %q", lang)
+	}
+	b, err := wordlists.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := GetFrom(lang, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	ws := make([]string, 2048, 2048)
+	for i := range ws {
+		ws[i] = string(w.Number(i))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ws, "\n") + "\n"))
+	if hex.EncodeToString(sum[:]) != wordlistSums[lang] {
+		return nil, fmt.Errorf("%s wordlist isn't the canonical one: sha256 %x, want %s", lang, sum, wordlistSums[lang])
+	}
+	return w, nil
+}
+
+// Load returns the wordlist of the language in the JSON file at path, for custom
+// wordlists.
+func Load(lang Language, path string) (*Words, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	d := json.NewDecoder(f)
+	return GetFrom(lang, f)
+}
+
+// GetFrom reads the wordlist of the language from the JSON of r, checking it's 2048
+// unique words in order, for wordlists that aren't files such as test fixtures.
+func GetFrom(lang Language, r io.Reader) (*Words, error) {
+	d := json.NewDecoder(r)
 	ws := make([]Word, 2048, 2048)
-	err = d.Decode(&ws)
+	err := d.Decode(&ws)
 	if err != nil {
 		return nil, err
 	}
-	result := Words{}
+	if len(ws) != 2048 {
+		return nil, fmt.Errorf("bad %s wordlist: %d words, want 2048", lang, len(ws))
+	}
+	c := collate.New(languageTags[lang])
+	result := Words{Language: lang, words: map[Word]int{}, indices: Indices{}}
 	for i, w := range ws {
-		result[w] = i
+		if w == "" {
+			return nil, fmt.Errorf("bad %s wordlist: word %d is empty", lang, i)
+		}
+		if j, ok := result.words[w]; ok {
+			return nil, fmt.Errorf("bad %s wordlist: word %d %q is also word %d", lang, i, w, j)
+		}
+		if i > 0 && c.CompareString(string(ws[i-1]), string(w)) > 0 {
+			return nil, fmt.Errorf("bad %s wordlist: word %d %q is before word %d %q", lang, i, w, i-1, ws[i-1])
+		}
+		result.words[w] = i
+		result.indices[i] = w
 	}
 	return &result, nil
 }
-
-
-func main() {
-	words, err := Get()
-	if err != nil { panic(err) }
-	fmt.Printf("there are %d words\n", len(*words))
-
-	mnemonic := "version keep first say nuclear barely middle castle husband leaf exotic illness"
-	mnem, err := words.NewMnemonic(mnemonic)
-	if err != nil { panic(err) }
-	fmt.Println(mnem.String())
-}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// english returns the embedded English wordlist, failing the test if it can't.
+func english(t testing.TB) *Words {
+	t.Helper()
+	w, err := Get(English)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// repeat returns the mnemonic of word n times followed by last.
+func repeat(word string, n int, last string) string {
+	return strings.TrimSpace(strings.Repeat(word+" ", n) + last)
+}
+
+func TestMnemonicLengths(t *testing.T) {
+	w := english(t)
+	// These are the BIP39 test vectors of all zero entropy.
+	valid := []struct{
+		mnemonic string
+		bits int
+	}{
+		{repeat("abandon", 11, "about"), 128},
+		{repeat("abandon", 14, "address"), 160},
+		{repeat("abandon", 17, "agent"), 192},
+		{repeat("abandon", 20, "admit"), 224},
+		{repeat("abandon", 23, "art"), 256},
+	}
+	for _, c := range valid {
+		m, err := w.NewMnemonic(c.mnemonic)
+		if err != nil {
+			t.Errorf("%d words: %v", len(strings.Fields(c.mnemonic)), err)
+			continue
+		}
+		if m.Bits != c.bits {
+			t.Errorf("%d words: %d bits, want %d", len(m.Words()), m.Bits, c.bits)
+		}
+		entropy, err := m.Entropy()
+		if err != nil {
+			t.Errorf("%d words: %v", len(m.Words()), err)
+			continue
+		}
+		if len(entropy)*8 != c.bits {
+			t.Errorf("%d words: %d bytes of entropy, want %d", len(m.Words()), len(entropy), c.bits/8)
+		}
+		for _, b := range entropy {
+			if b != 0 {
+				t.Errorf("%d words: entropy %x, want zeros", len(m.Words()), entropy)
+				break
+			}
+		}
+	}
+
+	invalid := []string{
+		"",
+		"abandon",
+		repeat("abandon", 10, "about"),
+		repeat("abandon", 12, "about"),
+		repeat("abandon", 15, "about"),
+		repeat("abandon", 24, "art"),
+	}
+	for _, mnemonic := range invalid {
+		_, err := w.NewMnemonic(mnemonic)
+		if err == nil || !strings.Contains(err.Error(), "bad number of words") {
+			t.Errorf("%d words: error %v, want bad number of words", len(strings.Fields(mnemonic)), err)
+		}
+	}
+}
+
+func TestMnemonicChecksum(t *testing.T) {
+	w := english(t)
+	for _, mnemonic := range []string{
+		repeat("abandon", 12, ""),
+		repeat("abandon", 14, "about"),
+		repeat("abandon", 23, "about"),
+	} {
+		_, err := w.NewMnemonic(mnemonic)
+		if err == nil || !strings.Contains(err.Error(), "bad checksum") {
+			t.Errorf("%d words: error %v, want bad checksum", len(strings.Fields(mnemonic)), err)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	w := english(t)
+	// These are the first BIP39 test vectors, all with the passphrase "TREZOR".
+	vectors := []struct{
+		mnemonic, seed string
+	}{
+		{
+			repeat("abandon", 11, "about"),
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+		},
+		{
+			"letter advice cage absurd amount doctor acoustic avoid letter advice cage above",
+			"d71de856f81a8acc65e6fc851a38d4d7ec216fd0796d0a6827a3ad6ed5511a30fa280f12eb2e47ed2ac03b5c462a0358d18d69fe4f985ec81778c1b370b652a8",
+		},
+		{
+			repeat("zoo", 11, "wrong"),
+			"ac27495480225222079d7be181583751e86f571027b0497b5b5d11218e0a8a13332572917f0f8e5a589620c6f15b11c61dee327651a14c34e18231052e48c069",
+		},
+	}
+	for _, v := range vectors {
+		m, err := w.NewMnemonic(v.mnemonic)
+		if err != nil {
+			t.Errorf("%q: %v", v.mnemonic, err)
+			continue
+		}
+		seed := hex.EncodeToString(m.Seed("TREZOR"))
+		if seed != v.seed {
+			t.Errorf("seed of %q\n got %s\nwant %s", v.mnemonic, seed, v.seed)
+		}
+	}
+}
+
+func TestEntropyRoundTrip(t *testing.T) {
+	w := english(t)
+	r := rand.New(rand.NewSource(28))
+	for i := 0; i < 50; i++ {
+		entropy := make([]byte, 16+4*(i%5))
+		r.Read(entropy)
+		m, err := w.FromEntropy(entropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Validate(w); err != nil {
+			t.Errorf("mnemonic of %x: %v", entropy, err)
+		}
+		got, err := m.Entropy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, entropy) {
+			t.Errorf("entropy %x, want %x", got, entropy)
+		}
+		// The words read back are the same mnemonic.
+		again, err := w.NewMnemonic(strings.Join(m.Words(), " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again.Words(), m.Words()) || again.Bits != m.Bits {
+			t.Errorf("words of %x read back as %q, want %q", entropy, again.Words(), m.Words())
+		}
+	}
+
+	for _, n := range []int{0, 12, 15, 17, 36} {
+		_, err := w.FromEntropy(make([]byte, n))
+		if err == nil {
+			t.Errorf("%d bytes of entropy: no error", n)
+		}
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	en := english(t)
+	es, err := Get(Spanish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("klingon"); err == nil {
+		t.Error("wordlist of an unknown language")
+	}
+	entropy := bytes.Repeat([]byte{0x7f}, 16)
+	mEn, err := en.FromEntropy(entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mEs, err := es.FromEntropy(entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mEn.Language != English || mEs.Language != Spanish {
+		t.Errorf("languages %q and %q, want %q and %q", mEn.Language, mEs.Language, English, Spanish)
+	}
+	if bytes.Equal(mEn.Seed(""), mEs.Seed("")) {
+		t.Error("the same entropy has the same seed in English and Spanish")
+	}
+	// The words of one language aren't a mnemonic of the other.
+	if _, err := es.NewMnemonic(strings.Join(mEn.Words(), " ")); err == nil {
+		t.Error("English words read as a Spanish mnemonic")
+	}
+	if err := mEs.Validate(en); err == nil {
+		t.Error("Spanish mnemonic validated against the English wordlist")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	w := english(t)
+	i, ok := w.Index("abandon")
+	if !ok || i != 0 {
+		t.Errorf("Index(abandon) = %d, %v, want 0, true", i, ok)
+	}
+	i, ok = w.Index("zoo")
+	if !ok || i != 2047 {
+		t.Errorf("Index(zoo) = %d, %v, want 2047, true", i, ok)
+	}
+	if _, ok := w.Index("bogus"); ok {
+		t.Error("Index(bogus) is in the wordlist")
+	}
+	// A bogus word in place of the first word isn't read as it.
+	_, err := w.NewMnemonic(repeat("abandon", 10, "bogus about"))
+	if err == nil || !strings.Contains(err.Error(), `[11] "bogus"`) {
+		t.Errorf("error %v, want word 11 not in the wordlist", err)
+	}
+}
+
+func TestSeedPassphrase(t *testing.T) {
+	w := english(t)
+	m, err := w.NewMnemonic(repeat("abandon", 11, "about"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := map[string]string{}
+	for _, p := range []string{"", "TREZOR", "trezor", "TREZOR "} {
+		seed := hex.EncodeToString(m.Seed(p))
+		if q, ok := seeds[seed]; ok {
+			t.Errorf("passphrases %q and %q have the same seed", q, p)
+		}
+		seeds[seed] = p
+	}
+	if !bytes.Equal(m.Seed("TREZOR"), m.Seed("TREZOR")) {
+		t.Error("the seed of a passphrase changes")
+	}
+}
+
+func TestNormalizedWords(t *testing.T) {
+	en := english(t)
+	m, err := en.NewMnemonic("Legal WINNER thank Year wave sausage worth useful legal winner thank yeLLow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Fields("legal winner thank year wave sausage worth useful legal winner thank yellow")
+	if !reflect.DeepEqual(m.Words(), want) {
+		t.Errorf("words %q, want %q", m.Words(), want)
+	}
+
+	// The Spanish wordlist is NFKD normalized, its accented letters decomposed,
+	// while they're usually typed composed, as NFC.
+	es, err := Get(Spanish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical, err := es.FromEntropy(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed := make([]string, len(canonical.Words()))
+	for i, word := range canonical.Words() {
+		typed[i] = strings.ToUpper(norm.NFC.String(word))
+	}
+	if typed[0] == canonical.Words()[0] || !strings.HasPrefix(typed[0], "Á") {
+		t.Fatalf("first word typed as %q, want an accented letter composed", typed[0])
+	}
+	m, err = es.NewMnemonic(strings.Join(typed, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Words(), canonical.Words()) {
+		t.Errorf("words %q, want %q", m.Words(), canonical.Words())
+	}
+	if !bytes.Equal(m.Seed(""), canonical.Seed("")) {
+		t.Error("the seed of words typed differently changes")
+	}
+}
+
+// customWords returns the English wordlist edited by edit, read as a custom one.
+func customWords(t *testing.T, edit func([]string) []string) *Words {
+	t.Helper()
+	en := english(t)
+	ws := make([]string, en.Len())
+	for i := range ws {
+		ws[i] = string(en.Number(i))
+	}
+	b, err := json.Marshal(edit(ws))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := GetFrom(English, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestDiff(t *testing.T) {
+	en := english(t)
+	if d := en.Diff(customWords(t, func(ws []string) []string { return ws })); len(d) != 0 {
+		t.Errorf("diff of the same words %q, want none", d)
+	}
+
+	replaced := customWords(t, func(ws []string) []string {
+		ws[1] = "abide"
+		return ws
+	})
+	want := []string{"-ability", "+abide"}
+	if d := en.Diff(replaced); !reflect.DeepEqual(d, want) {
+		t.Errorf("diff of a word replaced %q, want %q", d, want)
+	}
+	want = []string{"-abide", "+ability"}
+	if d := replaced.Diff(en); !reflect.DeepEqual(d, want) {
+		t.Errorf("diff the other way %q, want %q", d, want)
+	}
+
+	// Dropping the first word and adding one after the next two moves them.
+	shifted := customWords(t, func(ws []string) []string {
+		return append([]string{ws[1], ws[2], "ablest"}, ws[3:]...)
+	})
+	want = []string{"-abandon", "~ability", "~able", "+ablest"}
+	if d := en.Diff(shifted); !reflect.DeepEqual(d, want) {
+		t.Errorf("diff of a word moved %q, want %q", d, want)
+	}
+}
+
+func BenchmarkNumber(b *testing.B) {
+	w := english(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Number(i % 2048)
+	}
+}
+
+// BenchmarkNumberRebuilt is Number as it was, rebuilding the reverse map of the
+// words on every call, to compare BenchmarkNumber with.
+func BenchmarkNumberRebuilt(b *testing.B) {
+	w := english(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		indices := Indices{}
+		for k, v := range w.words {
+			indices[v] = k
+		}
+		_ = indices[i%2048]
+	}
+}
+
+func BenchmarkNewMnemonic(b *testing.B) {
+	w := english(b)
+	mnemonic := "legal winner thank year wave sausage worth useful legal winner thank yellow"
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := w.NewMnemonic(mnemonic)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/rugrah/ru
+
+go 1.16
+
+require (
+	github.com/makiuchi-d/gozxing v0.0.1
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	golang.org/x/text v0.3.6
+)
@@ -0,0 +1,216 @@
+package secretary
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// a frame is a message sealed by SealFrame, laid out as
+//
+//	version    1 byte, FrameVersion
+//	nonce      NonceSize bytes
+//	length     4 bytes, big-endian length of the ciphertext
+//	ciphertext length bytes, the message and its Poly1305 tag
+//
+// so it can be read without knowing anything of it beforehand
+
+const (
+	// FrameVersion is the version of the frames written
+	FrameVersion = 1
+
+	// tagSize is the length of the Poly1305 tag of every ciphertext
+	tagSize = 16
+
+	// frameHeader is the length of a frame before its ciphertext
+	frameHeader = 1 + NonceSize + 4
+
+	// MaxFrameSize is the most ciphertext a frame may hold, reading a frame never
+	// allocates more
+	MaxFrameSize = 64 << 20
+
+	// FrameOverhead is how much longer than its message a frame is
+	FrameOverhead = frameHeader + tagSize
+)
+
+// writeFrame writes the frame of ciphertext sealed under nonce to w
+func writeFrame(w io.Writer, nonce *[NonceSize]byte, ciphertext []byte) error {
+	if len(ciphertext) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes is larger than %d", len(ciphertext), MaxFrameSize)
+	}
+	header := [frameHeader]byte{FrameVersion}
+	copy(header[1:], nonce[:])
+	binary.BigEndian.PutUint32(header[1+NonceSize:], uint32(len(ciphertext)))
+	_, err := w.Write(header[:])
+	if err != nil { return err }
+	_, err = w.Write(ciphertext)
+	return err
+}
+
+// frame versions are never retired: a frame of any version ever written must stay
+// readable, as sealed secrets outlive the serv that sealed them; a new layout gets
+// a new version with a reader of its own in frameReaders, the old readers are left
+// as they are, and only FrameVersion is ever written
+//
+// version 1 is the layout above
+
+// frameReaders reads the rest of a frame of each version, after its version byte
+var frameReaders = map[byte]func(r io.Reader) (*[NonceSize]byte, []byte, error){
+	1: readFrameV1,
+}
+
+// readFrame reads the next frame of r, of any version, returning its nonce and
+// ciphertext; it's io.EOF if r ends before the frame begins, and an error if
+// within it
+func readFrame(r io.Reader) (*[NonceSize]byte, []byte, error) {
+	version := [1]byte{}
+	_, err := io.ReadFull(r, version[:])
+	if err == io.EOF {
+		return nil, nil, io.EOF
+	}
+	if err != nil { return nil, nil, err }
+	read, ok := frameReaders[version[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown frame version %d", version[0])
+	}
+	return read(r)
+}
+
+// readFrameV1 reads a version 1 frame: its nonce, length and ciphertext
+func readFrameV1(r io.Reader) (*[NonceSize]byte, []byte, error) {
+	header := [frameHeader - 1]byte{}
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("%w frame header: %d of %d bytes", ErrTruncated, 1+n, frameHeader)
+	}
+	if err != nil { return nil, nil, err }
+	nonce := &[NonceSize]byte{}
+	copy(nonce[:], header[:NonceSize])
+	l := binary.BigEndian.Uint32(header[NonceSize:])
+	if l < tagSize || l > MaxFrameSize {
+		return nil, nil, fmt.Errorf("bad frame length %d", l)
+	}
+	ciphertext := make([]byte, l)
+	n, err = io.ReadFull(r, ciphertext)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("%w frame: %d of %d bytes", ErrTruncated, n, l)
+	}
+	if err != nil { return nil, nil, err }
+	return nonce, ciphertext, nil
+}
+
+// SealFrame seals msg with the shared key as SealAD does, writing it to w as a
+// frame; it returns the nonce, which is new for every frame
+func SealFrame(w io.Writer, msg, ad []byte, shared *[32]byte) ([]byte, error) {
+	nonce, err := NewNonce()
+	if err != nil { return nil, err }
+	return sealFrame(w, msg, ad, nonce, shared)
+}
+
+// SealFrameSynthetic is SealFrame with the nonce of SyntheticNonce, so sealing the
+// same msg and ad with the same key again writes the very same frame
+func SealFrameSynthetic(w io.Writer, msg, ad []byte, shared *[32]byte) ([]byte, error) {
+	return sealFrame(w, msg, ad, SyntheticNonce(msg, ad, shared), shared)
+}
+
+// sealBufs are buffers for the ciphertext of a chunk, reused from frame to frame as
+// it's written out before sealFrame returns; sealing a stream of chunks then hardly
+// allocates at all
+var sealBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, ChunkSize+tagSize)
+		return &b
+	},
+}
+
+func sealFrame(w io.Writer, msg, ad []byte, nonce *[NonceSize]byte, shared *[32]byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(shared[:])
+	if err != nil { return nil, err }
+	var out []byte
+	if len(msg) <= ChunkSize {
+		buf := sealBufs.Get().(*[]byte)
+		defer sealBufs.Put(buf)
+		out = (*buf)[:0]
+	}
+	err = writeFrame(w, nonce, aead.Seal(out, nonce[:], msg, ad))
+	if err != nil { return nil, err }
+	return nonce[:], nil
+}
+
+// SyntheticNonce derives the nonce to seal msg with ad under the shared key from all
+// three, as SIV does: the HMAC-SHA256 of ad and msg under a key of its own derived
+// from shared, cut to NonceSize
+//
+// a nonce must never seal two different messages under one key, here it only
+// ever seals the one message and ad it was derived from, which give the same
+// ciphertext every time; the cost is that sealing the same message twice shows
+func SyntheticNonce(msg, ad []byte, shared *[32]byte) *[NonceSize]byte {
+	kdf := hmac.New(sha256.New, shared[:])
+	kdf.Write([]byte("secretary synthetic nonce"))
+	k := kdf.Sum(nil)
+	defer Wipe(k)
+	mac := hmac.New(sha256.New, k)
+	l := [8]byte{}
+	binary.BigEndian.PutUint64(l[:], uint64(len(ad)))
+	mac.Write(l[:])
+	mac.Write(ad)
+	mac.Write(msg)
+	nonce := &[NonceSize]byte{}
+	copy(nonce[:], mac.Sum(nil))
+	return nonce
+}
+
+// OpenFrame reads the next frame of r and opens it with the same ad it was sealed
+// with, returning the message and its nonce; it's io.EOF if r has no more frames
+func OpenFrame(r io.Reader, ad []byte, shared *[32]byte) ([]byte, []byte, error) {
+	nonce, ciphertext, err := readFrame(r)
+	if err != nil { return nil, nil, err }
+	msg, err := openFrame(nonce, ciphertext, ad, shared)
+	if err != nil { return nil, nil, err }
+	return msg, nonce[:], nil
+}
+
+// openFrame opens the ciphertext of a frame, leaving it as it was if that fails
+func openFrame(nonce *[NonceSize]byte, ciphertext, ad []byte, shared *[32]byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(shared[:])
+	if err != nil { return nil, err }
+	msg, err := aead.Open(nil, nonce[:], ciphertext, ad)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return msg, nil
+}
+
+// SealBytes seals plaintext from the keypair of senderPrv to recipientPub as a single
+// frame under a new nonce, for sealing in memory with nothing but the two keys
+func SealBytes(plaintext []byte, recipientPub, senderPrv Key) ([]byte, error) {
+	shared := Precompute(recipientPub, senderPrv)
+	defer Wipe(shared[:])
+	buf := bytes.NewBuffer(make([]byte, 0, len(plaintext)+FrameOverhead))
+	_, err := SealFrame(buf, plaintext, nil, shared)
+	if err != nil { return nil, err }
+	return buf.Bytes(), nil
+}
+
+// OpenBytes opens ciphertext, as returned by SealBytes from senderPub to the
+// keypair of recipientPrv; anything after its frame is an error
+func OpenBytes(ciphertext []byte, senderPub, recipientPrv Key) ([]byte, error) {
+	shared := Precompute(senderPub, recipientPrv)
+	defer Wipe(shared[:])
+	r := bytes.NewReader(ciphertext)
+	msg, _, err := OpenFrame(r, nil, shared)
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: no frame", ErrTruncated)
+	}
+	if err != nil { return nil, err }
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes after the frame", r.Len())
+	}
+	return msg, nil
+}
@@ -0,0 +1,269 @@
+package secretary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sealedFrame is a frame of msg sealed under a new shared key
+func sealedFrame(t *testing.T, msg []byte) ([]byte, *[32]byte) {
+	t.Helper()
+	_, senderPrv, recipientPub, _ := testKeys(t)
+	shared := Precompute(recipientPub, senderPrv)
+	buf := &bytes.Buffer{}
+	_, err := SealFrame(buf, msg, nil, shared)
+	if err != nil { t.Fatal(err) }
+	return buf.Bytes(), shared
+}
+
+func TestFrameLayout(t *testing.T) {
+	msg := pattern(100)
+	frame, shared := sealedFrame(t, msg)
+	if len(frame) != len(msg)+FrameOverhead {
+		t.Fatalf("frame of %d bytes, want %d", len(frame), len(msg)+FrameOverhead)
+	}
+	if frame[0] != FrameVersion {
+		t.Errorf("frame version %d, want %d", frame[0], FrameVersion)
+	}
+	if l := binary.BigEndian.Uint32(frame[1+NonceSize:]); int(l) != len(msg)+tagSize {
+		t.Errorf("frame length %d, want %d", l, len(msg)+tagSize)
+	}
+	// frames follow one another, and the end of the last is io.EOF
+	r := bytes.NewReader(append(append([]byte{}, frame...), frame...))
+	for i := 0; i < 2; i++ {
+		got, nonce, err := OpenFrame(r, nil, shared)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(got, msg) || !bytes.Equal(nonce, frame[1:1+NonceSize]) {
+			t.Errorf("frame %d opened as %d bytes under nonce %x", i, len(got), nonce)
+		}
+	}
+	if _, _, err := OpenFrame(r, nil, shared); err != io.EOF {
+		t.Errorf("after the last frame: %v, want io.EOF", err)
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	frame, shared := sealedFrame(t, pattern(100))
+	for n := 1; n < len(frame); n++ {
+		_, _, err := OpenFrame(bytes.NewReader(frame[:n]), nil, shared)
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("frame cut to %d of %d bytes: %v, want ErrTruncated", n, len(frame), err)
+		}
+	}
+	if _, _, err := OpenFrame(bytes.NewReader(nil), nil, shared); err != io.EOF {
+		t.Errorf("no frame: %v, want io.EOF", err)
+	}
+}
+
+func TestFrameBadLength(t *testing.T) {
+	frame, shared := sealedFrame(t, pattern(100))
+	for _, l := range []uint32{0, tagSize - 1, MaxFrameSize + 1, 1<<32 - 1} {
+		b := append([]byte{}, frame...)
+		binary.BigEndian.PutUint32(b[1+NonceSize:], l)
+		_, _, err := OpenFrame(bytes.NewReader(b), nil, shared)
+		if err == nil || errors.Is(err, ErrTruncated) {
+			t.Errorf("frame length %d: %v, want a bad length", l, err)
+		}
+	}
+	// a longer length than the frame has is a truncated frame
+	b := append([]byte{}, frame...)
+	binary.BigEndian.PutUint32(b[1+NonceSize:], uint32(len(frame)))
+	if _, _, err := OpenFrame(bytes.NewReader(b), nil, shared); !errors.Is(err, ErrTruncated) {
+		t.Errorf("frame length past its end: %v, want ErrTruncated", err)
+	}
+}
+
+func TestSyntheticNonce(t *testing.T) {
+	_, senderPrv, recipientPub, _ := testKeys(t)
+	shared := Precompute(recipientPub, senderPrv)
+	_, otherPrv, _, _ := testKeys(t)
+	other := Precompute(recipientPub, otherPrv)
+
+	// every chunk of a file, and of another file, gets a nonce of its own
+	data := pattern(1000 * 64)
+	seen := map[[NonceSize]byte]string{}
+	for _, ad := range []string{"file", "other file"} {
+		for i := 0; i < 1000; i++ {
+			chunk := data[i*64 : (i+1)*64]
+			nonce := SyntheticNonce(chunk, []byte(ad), shared)
+			if prev, ok := seen[*nonce]; ok {
+				t.Fatalf("chunk %d of %s has the nonce of %s", i, ad, prev)
+			}
+			seen[*nonce] = ad
+			if again := SyntheticNonce(chunk, []byte(ad), shared); *again != *nonce {
+				t.Fatalf("chunk %d of %s: nonce %x then %x", i, ad, nonce, again)
+			}
+		}
+	}
+	msg := data[:64]
+	nonce := SyntheticNonce(msg, []byte("file"), shared)
+	if *SyntheticNonce(msg, []byte("file"), other) == *nonce {
+		t.Error("the nonce of a chunk is the same under another key")
+	}
+	// the length of ad is part of the nonce, so where ad ends and msg begins is
+	if *SyntheticNonce(append([]byte("e"), msg...), []byte("fil"), shared) == *nonce {
+		t.Error("the nonce of ad and msg split elsewhere is the same")
+	}
+
+	// the very same frame, twice
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	_, err := SealFrameSynthetic(a, msg, []byte("file"), shared)
+	if err != nil { t.Fatal(err) }
+	_, err = SealFrameSynthetic(b, msg, []byte("file"), shared)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("sealing the same chunk again wrote a different frame")
+	}
+	if !bytes.Equal(a.Bytes()[1:1+NonceSize], nonce[:]) {
+		t.Errorf("frame sealed under %x, want %x", a.Bytes()[1:1+NonceSize], nonce)
+	}
+}
+
+func TestSealBytes(t *testing.T) {
+	senderPub, senderPrv, recipientPub, recipientPrv := testKeys(t)
+	for _, n := range []int{0, 1, 100, ChunkSize + 1} {
+		msg := pattern(n)
+		sealed, err := SealBytes(msg, recipientPub, senderPrv)
+		if err != nil { t.Fatal(err) }
+		if len(sealed) != n+FrameOverhead {
+			t.Errorf("%d bytes sealed as %d, want %d", n, len(sealed), n+FrameOverhead)
+		}
+		got, err := OpenBytes(sealed, senderPub, recipientPrv)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(got, msg) {
+			t.Errorf("%d bytes opened as %d others", n, len(got))
+		}
+	}
+
+	msg := []byte("attack at dawn")
+	sealed, err := SealBytes(msg, recipientPub, senderPrv)
+	if err != nil { t.Fatal(err) }
+	again, err := SealBytes(msg, recipientPub, senderPrv)
+	if err != nil { t.Fatal(err) }
+	if bytes.Equal(sealed[1:1+NonceSize], again[1:1+NonceSize]) {
+		t.Error("sealed twice under the same nonce")
+	}
+	// every byte past the version is authenticated, the nonce and length included
+	for i := 1; i < len(sealed); i++ {
+		b := append([]byte{}, sealed...)
+		b[i] ^= 0x01
+		if got, err := OpenBytes(b, senderPub, recipientPrv); err == nil {
+			t.Errorf("opened with byte %d flipped: %q", i, got)
+		}
+	}
+	_, otherPrv, _, _ := testKeys(t)
+	if _, err := OpenBytes(sealed, senderPub, otherPrv); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("opened by another recipient: %v, want ErrAuthFailed", err)
+	}
+	if _, err := OpenBytes(append(sealed, 0), senderPub, recipientPrv); err == nil {
+		t.Error("opened with a byte after the frame")
+	}
+	if _, err := OpenBytes(sealed[:len(sealed)-1], senderPub, recipientPrv); !errors.Is(err, ErrTruncated) {
+		t.Errorf("opened cut short: %v, want ErrTruncated", err)
+	}
+	if _, err := OpenBytes(nil, senderPub, recipientPrv); !errors.Is(err, ErrTruncated) {
+		t.Errorf("opened nothing: %v, want ErrTruncated", err)
+	}
+}
+
+// v1Frame is a version 1 frame of v1Message with v1AD under the sha256 of
+// "secretary frame v1", sealed by SealFrameSynthetic; whatever FrameVersion
+// becomes, it must keep opening
+const (
+	v1Frame = "01c219c47e7d5df551e5dc97e7b2f60b4a60c29e6baa4ea68f00000029850e813d14b18d552f6bf84abf954cd00a08a12763b7dd70081ad6267b4e51046d21ec0685f2ede3f4"
+	v1Message = "sealed by frame version 1"
+	v1AD = "names/a file"
+)
+
+func TestFrameV1(t *testing.T) {
+	shared := sha256.Sum256([]byte("secretary frame v1"))
+	msg, nonce, err := OpenFrame(bytes.NewReader(unhex(t, v1Frame)), []byte(v1AD), &shared)
+	if err != nil { t.Fatal(err) }
+	if string(msg) != v1Message {
+		t.Errorf("opened %q, want %q", msg, v1Message)
+	}
+	if !bytes.Equal(nonce, unhex(t, v1Frame)[1:1+NonceSize]) {
+		t.Errorf("nonce %x isn't the frame's", nonce)
+	}
+	if FrameVersion == 1 {
+		buf := &bytes.Buffer{}
+		_, err := SealFrameSynthetic(buf, []byte(v1Message), []byte(v1AD), &shared)
+		if err != nil { t.Fatal(err) }
+		if got := hex.EncodeToString(buf.Bytes()); got != v1Frame {
+			t.Errorf("sealed %s, want %s", got, v1Frame)
+		}
+	}
+}
+
+func TestFrameUnknownVersion(t *testing.T) {
+	shared := sha256.Sum256([]byte("secretary frame v1"))
+	for _, v := range []byte{0, 2, 255} {
+		b := unhex(t, v1Frame)
+		b[0] = v
+		_, _, err := OpenFrame(bytes.NewReader(b), []byte(v1AD), &shared)
+		if err == nil || err == io.EOF || errors.Is(err, ErrTruncated) || errors.Is(err, ErrAuthFailed) {
+			t.Errorf("frame version %d: %v, want an unknown version", v, err)
+		}
+	}
+}
+
+// unpooledFrame is the frame sealFrame writes, sealed into a new slice as it was
+// before sealBufs
+func unpooledFrame(w io.Writer, msg, ad []byte, nonce *[NonceSize]byte, shared *[32]byte) error {
+	aead, err := chacha20poly1305.NewX(shared[:])
+	if err != nil { return err }
+	return writeFrame(w, nonce, aead.Seal(nil, nonce[:], msg, ad))
+}
+
+func TestSealFramePooled(t *testing.T) {
+	shared := sha256.Sum256([]byte("secretary frame v1"))
+	// the buffers come back from the pool holding the chunks before, longer or not
+	for _, n := range []int{ChunkSize, 0, 1, 100, ChunkSize - 1, ChunkSize + 1, 100} {
+		msg := pattern(n)
+		nonce := SyntheticNonce(msg, []byte(v1AD), &shared)
+		pooled, unpooled := &bytes.Buffer{}, &bytes.Buffer{}
+		_, err := SealFrameSynthetic(pooled, msg, []byte(v1AD), &shared)
+		if err != nil { t.Fatal(err) }
+		err = unpooledFrame(unpooled, msg, []byte(v1AD), nonce, &shared)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(pooled.Bytes(), unpooled.Bytes()) {
+			t.Errorf("frame of %d bytes isn't the one sealed without the pool", n)
+		}
+	}
+}
+
+func BenchmarkSealFrame(b *testing.B) {
+	shared := sha256.Sum256([]byte("secretary frame v1"))
+	msg := pattern(ChunkSize)
+	b.SetBytes(ChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := SealFrame(ioutil.Discard, msg, nil, &shared)
+		if err != nil { b.Fatal(err) }
+	}
+}
+
+// BenchmarkSealFrameUnpooled is SealFrame sealing into a new slice every frame, to
+// compare BenchmarkSealFrame with
+func BenchmarkSealFrameUnpooled(b *testing.B) {
+	shared := sha256.Sum256([]byte("secretary frame v1"))
+	msg := pattern(ChunkSize)
+	b.SetBytes(ChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nonce, err := NewNonce()
+		if err != nil { b.Fatal(err) }
+		err = unpooledFrame(ioutil.Discard, msg, nil, nonce, &shared)
+		if err != nil { b.Fatal(err) }
+	}
+}
@@ -0,0 +1,30 @@
+package secretary
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// fingerprintLen is how many hex digits of a checksum make a fingerprint
+const fingerprintLen = 16
+
+// Hello returns the fingerprint of the checksum the digest at digestPath, serv's
+// crypt/digest.json, records for name, the first few hex digits of it, or "" when
+// name isn't tracked or there's no digest
+func Hello(digestPath, name string) string {
+	b, err := ioutil.ReadFile(digestPath)
+	if err != nil {
+		return ""
+	}
+	d := map[string]struct{
+		Sum string `json:"sum"`
+	}{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return ""
+	}
+	sum := d[name].Sum
+	if len(sum) > fingerprintLen {
+		sum = sum[:fingerprintLen]
+	}
+	return sum
+}
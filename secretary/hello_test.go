@@ -0,0 +1,29 @@
+package secretary
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	digest := filepath.Join(t.TempDir(), "digest.json")
+	err := ioutil.WriteFile(digest, []byte(`{
+		"a.txt": {"sum": "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "size": 3},
+		"short": {"sum": "0123"}
+	}`), 0600)
+	if err != nil { t.Fatal(err) }
+
+	for _, c := range []struct{
+		digest, name, want string
+	}{
+		{digest, "a.txt", "0123456789abcdef"},
+		{digest, "short", "0123"},
+		{digest, "unknown.txt", ""},
+		{filepath.Join(filepath.Dir(digest), "none.json"), "a.txt", ""},
+	} {
+		if got := Hello(c.digest, c.name); got != c.want {
+			t.Errorf("Hello(%s, %q) = %q, want %q", filepath.Base(c.digest), c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package secretary
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/salsa20"
+)
+
+// KDFParams are the argon2id costs of stretching the passphrase, recorded with
+// whatever it protects so it's stretched identically to open it again
+type KDFParams struct{
+	Time uint32 `json:"time"`
+	Memory uint32 `json:"memory"`
+	Threads uint8 `json:"threads"`
+}
+
+// DefaultKDF are the costs x/crypto/argon2 recommends: one pass over 64MiB
+var DefaultKDF = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// stretch derives the key of the recipient keystream from the passphrase, salted
+// by the file's sum so no two files share a stretched key
+//
+// without params the passphrase is only hashed, as it was before stretching
+func stretch(passphrase []byte, sum [32]byte, kdf *KDFParams) [32]byte {
+	if kdf == nil {
+		return sha256.Sum256(passphrase)
+	}
+	b := argon2.IDKey(passphrase, sum[:], kdf.Time, kdf.Memory, kdf.Threads, 32)
+	defer Wipe(b)
+	k := [32]byte{}
+	copy(k[:], b)
+	return k
+}
+
+// RecipientKey derives the recipient keypair of a file from its contents and the
+// shared passphrase, the same file and passphrase always yield the same recipient
+//
+// with sum the sha256 sum of the file, the private key is sum XOR'd with the
+// xsalsa20 keystream keyed by the passphrase stretched with argon2id under the
+// nonce sum[:24], and the public key is the x25519 base point multiplied by it:
+//
+//	sum = sha256(fileContents)
+//	k   = argon2id(passphrase, salt = sum, kdf)
+//	prv = sum ^ xsalsa20(key = k, nonce = sum[:24])
+//	pub = x25519(prv, basepoint)
+//
+// keying the stream by the file's own sum gives every file a distinct keystream,
+// so learning one file's private key reveals nothing about another's
+func RecipientKey(fileContents []byte, passphrase []byte) (pub, prv Key, err error) {
+	sum := sha256.Sum256(fileContents)
+	return DeriveRecipient(sum, passphrase, &DefaultKDF)
+}
+
+// DeriveRecipient is RecipientKey given the sha256 sum of the file, which is all
+// decryption has of the file
+func DeriveRecipient(sum [32]byte, passphrase []byte, kdf *KDFParams) (pub, prv Key, err error) {
+	k := stretch(passphrase, sum, kdf)
+	defer Zero(&k)
+	prv = &[32]byte{}
+	salsa20.XORKeyStream(prv[:], sum[:], sum[:24], &k)
+
+	pub, err = PublicKey(prv)
+	if err != nil {
+		Zero(prv)
+		return nil, nil, err
+	}
+	return pub, prv, nil
+}
@@ -0,0 +1,71 @@
+package secretary
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/salsa20"
+)
+
+// kdfTest stretches passphrases cheaply, for tests deriving many recipients
+var kdfTest = &KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+func TestRecipientKeyDeterministic(t *testing.T) {
+	file, passphrase := []byte("the file's contents"), []byte("passphrase")
+	pub1, prv1, err := RecipientKey(file, passphrase)
+	if err != nil { t.Fatal(err) }
+	pub2, prv2, err := RecipientKey(append([]byte{}, file...), append([]byte{}, passphrase...))
+	if err != nil { t.Fatal(err) }
+	if *pub1 != *pub2 || *prv1 != *prv2 {
+		t.Errorf("the same file and passphrase derived two recipients")
+	}
+	pub, err := PublicKey(prv1)
+	if err != nil || *pub != *pub1 {
+		t.Errorf("the public key isn't that of the private key: %v", err)
+	}
+}
+
+func TestRecipientKeyDistinct(t *testing.T) {
+	seen := map[[32]byte]string{}
+	for _, c := range []struct{
+		file, passphrase string
+	}{
+		{"a", "passphrase"},
+		{"b", "passphrase"},
+		{"a", "passphrasf"},
+		{"", "passphrase"},
+		{"a", "passphrase "},
+	} {
+		pub, _, err := DeriveRecipient(sha256.Sum256([]byte(c.file)), []byte(c.passphrase), kdfTest)
+		if err != nil { t.Fatal(err) }
+		what := c.file + " under " + c.passphrase
+		if other, ok := seen[*pub]; ok {
+			t.Errorf("%q and %q derived the same recipient", what, other)
+		}
+		seen[*pub] = what
+	}
+}
+
+// TestDeriveRecipientAsDocumented derives a recipient step by step as RecipientKey's
+// doc has it, and without a KDF as before stretching
+func TestDeriveRecipientAsDocumented(t *testing.T) {
+	sum := sha256.Sum256([]byte("the file's contents"))
+	passphrase := []byte("passphrase")
+	for _, kdf := range []*KDFParams{kdfTest, nil} {
+		k := [32]byte{}
+		if kdf == nil {
+			k = sha256.Sum256(passphrase)
+		} else {
+			copy(k[:], argon2.IDKey(passphrase, sum[:], kdf.Time, kdf.Memory, kdf.Threads, 32))
+		}
+		want := [32]byte{}
+		salsa20.XORKeyStream(want[:], sum[:], sum[:24], &k)
+
+		_, prv, err := DeriveRecipient(sum, passphrase, kdf)
+		if err != nil { t.Fatal(err) }
+		if *prv != want {
+			t.Errorf("with KDF %v: private key %x, want %x", kdf, prv[:], want[:])
+		}
+	}
+}
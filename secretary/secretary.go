@@ -0,0 +1,166 @@
+// secretary seals and opens the secrets kept by serv
+//
+// a message is sealed with nacl/box from a sender's keypair to a recipient's, under
+// a random nonce stored as the prefix of the sealed message; recipients are derived
+// from a passphrase, see DeriveRecipient
+//
+// SealAD and OpenAD seal with XChaCha20-Poly1305 under the same shared key instead,
+// binding the sealed message to additional data that box can't
+//
+// SealBytes and OpenBytes seal a message in memory between two keypairs, as a frame
+package secretary
+
+import (
+	crypto_rand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// Version is the version of secretary; what it seals is versioned apart, by
+	// FrameVersion, as the format changes far less often than the code
+	Version = "0.1.0"
+
+	// NonceSize is the length of the nonce prefixing every sealed message
+	NonceSize = 24
+
+	// Overhead is how much longer than its message a sealed message is
+	Overhead = NonceSize + box.Overhead
+)
+
+var (
+	// ErrAuthFailed is the error of opening a message that isn't authentic: sealed
+	// under another key or with other additional data, or changed since
+	ErrAuthFailed = errors.New("message not authentic")
+
+	// ErrTruncated is the error of reading a frame or stream cut short
+	ErrTruncated = errors.New("truncated")
+)
+
+// Key is a curve25519 public or private key
+type Key *[32]byte
+
+// Zero wipes the key k, for private keys once they are no longer needed
+//
+// the garbage collector may still have copied the key elsewhere, but wiping the
+// arrays we control narrows the window the key sits in memory
+func Zero(k Key) {
+	if k == nil {
+		return
+	}
+	Wipe(k[:])
+}
+
+// Wipe zeroes b, for any other secret bytes such as a passphrase
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// random is the source of keys and nonces, only ever replaced by a seeded reader
+// to pin the exact bytes sealed, as stored data depends on them not changing
+var random io.Reader = crypto_rand.Reader
+
+// GenerateKey generates a random keypair
+func GenerateKey() (pub, prv Key, err error) {
+	return box.GenerateKey(random)
+}
+
+// NewKey returns a random key, to seal under as a shared key would be
+func NewKey() (*[32]byte, error) {
+	k := &[32]byte{}
+	if _, err := io.ReadFull(random, k[:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Precompute returns the key shared by a keypair and a peer's public key, sealing
+// from prv to peerPub and opening from peerPub to prv both use it
+func Precompute(peerPub, prv Key) *[32]byte {
+	shared := &[32]byte{}
+	box.Precompute(shared, peerPub, prv)
+	return shared
+}
+
+// NewNonce returns a random nonce
+//
+// we must use a different nonce for each message you encrypt with the
+// same key
+//
+// since the nonce here is 192 bits long, a random value
+// provides a sufficiently small probability of repeats
+func NewNonce() (*[NonceSize]byte, error) {
+	nonce := &[NonceSize]byte{}
+	if _, err := io.ReadFull(random, nonce[:]); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Seal encrypts and authenticates msg with the shared key, appending a new nonce
+// followed by the sealed message to out
+func Seal(out, msg []byte, shared *[32]byte) ([]byte, error) {
+	nonce, err := NewNonce()
+	if err != nil { return nil, err }
+	out = append(out, nonce[:]...)
+	return box.SealAfterPrecomputation(out, msg, nonce, shared), nil
+}
+
+// Open authenticates and decrypts sealed, as returned by Seal, appending the
+// message to out
+func Open(out, sealed []byte, shared *[32]byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, fmt.Errorf("bad length of sealed message %d", len(sealed))
+	}
+
+	// to decrypt, we must use same nonce we used to encrypt message, which is
+	// stored alongside the encrypted message
+	nonce := [NonceSize]byte{}
+	copy(nonce[:], sealed[:NonceSize])
+	msg, ok := box.OpenAfterPrecomputation(out, sealed[NonceSize:], &nonce, shared)
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+	return msg, nil
+}
+
+// SealAD is Seal, additionally authenticating but not encrypting ad, which must
+// be given again to open it
+func SealAD(out, msg, ad []byte, shared *[32]byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(shared[:])
+	if err != nil { return nil, err }
+	nonce, err := NewNonce()
+	if err != nil { return nil, err }
+	out = append(out, nonce[:]...)
+	return aead.Seal(out, nonce[:], msg, ad), nil
+}
+
+// OpenAD opens sealed, as returned by SealAD with the same ad
+func OpenAD(out, sealed, ad []byte, shared *[32]byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, fmt.Errorf("bad length of sealed message %d", len(sealed))
+	}
+	aead, err := chacha20poly1305.NewX(shared[:])
+	if err != nil { return nil, err }
+	msg, err := aead.Open(out, sealed[:NonceSize], sealed[NonceSize:], ad)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return msg, nil
+}
+
+// PublicKey returns the public key of the private key prv
+func PublicKey(prv Key) (Key, error) {
+	b, err := curve25519.X25519(prv[:], curve25519.Basepoint)
+	if err != nil { return nil, err }
+	pub := &[32]byte{}
+	copy(pub[:], b)
+	return pub, nil
+}
@@ -0,0 +1,108 @@
+package secretary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// seededReader is a stream of the sha256 of its seed and a counter, a source of
+// random for pinning exactly what's sealed
+type seededReader struct{
+	seed []byte
+	n uint64
+	buf []byte
+}
+
+func (sr *seededReader) Read(p []byte) (int, error) {
+	for i := range p {
+		if len(sr.buf) == 0 {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, sr.n)
+			sum := sha256.Sum256(append(append([]byte{}, sr.seed...), b...))
+			sr.buf = sum[:]
+			sr.n++
+		}
+		p[i] = sr.buf[0]
+		sr.buf = sr.buf[1:]
+	}
+	return len(p), nil
+}
+
+// seedRandom has random read from a seededReader of seed until the test is done
+func seedRandom(t *testing.T, seed string) {
+	old := random
+	random = &seededReader{seed: []byte(seed)}
+	t.Cleanup(func() { random = old })
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil { t.Fatal(err) }
+	return b
+}
+
+// the keys and messages of the known answers, which must never change: whatever is
+// stored was sealed by them
+const (
+	kaMessage = "attack at dawn"
+	kaPassphrase = "correct horse battery staple"
+	kaSenderPub = "a604b7fb71e6eafb08fe8bd767fa6cd2e5b4e7f14a11ffb6487d651bad69ab0d"
+	kaRecipientPub = "df262c9365b528220ad2dce1ed356364710fd8efb038d4a2ff697f9e9a2e821e"
+	kaSealed = "ad0cb6440e7085f0056527ece0c3ab12e0c075642ec5363effddce3444c21741a4478ce9a07efe51124763e9fbfb46220c906b9f3558"
+	kaFrame = "01425cee3433ca3e89707cdb0c783bd55b50f8a0fb9529f2850000001e80ec287fc517244ef59c9a6f4ae74cbac70295dbe6dccdcd5aabca2855ba"
+)
+
+func TestKnownAnswer(t *testing.T) {
+	seedRandom(t, "secretary known answer")
+	senderPub, senderPrv, err := GenerateKey()
+	if err != nil { t.Fatal(err) }
+	recipientPub, recipientPrv, err := RecipientKey([]byte("the file's contents"), []byte(kaPassphrase))
+	if err != nil { t.Fatal(err) }
+	if got := hex.EncodeToString(senderPub[:]); got != kaSenderPub {
+		t.Errorf("sender's public key %s, want %s", got, kaSenderPub)
+	}
+	if got := hex.EncodeToString(recipientPub[:]); got != kaRecipientPub {
+		t.Errorf("recipient's public key %s, want %s", got, kaRecipientPub)
+	}
+
+	shared := Precompute(recipientPub, senderPrv)
+	sealed, err := Seal(nil, []byte(kaMessage), shared)
+	if err != nil { t.Fatal(err) }
+	if got := hex.EncodeToString(sealed); got != kaSealed {
+		t.Errorf("sealed %s, want %s", got, kaSealed)
+	}
+	frame := &bytes.Buffer{}
+	_, err = SealFrame(frame, []byte(kaMessage), []byte("ad"), shared)
+	if err != nil { t.Fatal(err) }
+	if got := hex.EncodeToString(frame.Bytes()); got != kaFrame {
+		t.Errorf("sealed the frame %s, want %s", got, kaFrame)
+	}
+
+	// the pinned bytes open with the recipient's keys, and not once changed
+	opening := Precompute(senderPub, recipientPrv)
+	msg, err := Open(nil, unhex(t, kaSealed), opening)
+	if err != nil || string(msg) != kaMessage {
+		t.Errorf("opened %q: %v", msg, err)
+	}
+	msg, _, err = OpenFrame(bytes.NewReader(unhex(t, kaFrame)), []byte("ad"), opening)
+	if err != nil || string(msg) != kaMessage {
+		t.Errorf("opened the frame %q: %v", msg, err)
+	}
+	for i := range unhex(t, kaSealed) {
+		b := unhex(t, kaSealed)
+		b[i] ^= 0x80
+		msg, err := Open(nil, b, opening)
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("opened with byte %d flipped: %q, %v", i, msg, err)
+		}
+	}
+	_, _, err = OpenFrame(bytes.NewReader(unhex(t, kaFrame)), []byte("da"), opening)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("opened the frame with other additional data: %v", err)
+	}
+}
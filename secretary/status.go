@@ -0,0 +1,90 @@
+package secretary
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileStatus is what a store's crypt/ records of one file serv has encrypted
+type FileStatus struct{
+	Name string
+	// Sum is the hex sha256 of the file when it was last encrypted
+	Sum string
+	Encrypted time.Time
+	// Chunks is how many chunks it was sealed into
+	Chunks int
+	// Present is whether all its chunks are in crypt/, Consistent whether they
+	// also match their checksums
+	Present bool
+	Consistent bool
+}
+
+// Status reports every file tracked in cryptDir, the crypt/ of a store, by name
+//
+// it only reads, needing neither the server's keys nor serv's lock; without the
+// keys digest.json can't be checked against its signature, so Status trusts it
+func Status(cryptDir string) ([]FileStatus, error) {
+	digest := map[string]struct{
+		Sum string `json:"sum"`
+		Encrypted time.Time `json:"encrypted"`
+		// Chunks is only in digests from before the manifest
+		Chunks []string `json:"chunks"`
+	}{}
+	err := readJSON(filepath.Join(cryptDir, "digest.json"), &digest)
+	if err != nil { return nil, err }
+	var manifest map[string][]string
+	err = readJSON(filepath.Join(cryptDir, "manifest.json"), &manifest)
+	if err != nil { return nil, err }
+
+	names := make([]string, 0, len(digest))
+	for name := range digest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]FileStatus, 0, len(names))
+	for _, name := range names {
+		e := digest[name]
+		chunks, listed := manifest[name]
+		if manifest == nil {
+			chunks, listed = e.Chunks, true
+		}
+		st := FileStatus{Name: name, Sum: e.Sum, Encrypted: e.Encrypted, Chunks: len(chunks), Present: listed, Consistent: listed}
+		dir := filepath.Join(cryptDir, filepath.FromSlash(path.Dir(name)))
+		for _, sum := range chunks {
+			b, err := ioutil.ReadFile(filepath.Join(dir, sum))
+			if os.IsNotExist(err) {
+				st.Present, st.Consistent = false, false
+				break
+			}
+			if err != nil { return nil, err }
+			got := sha256.Sum256(b)
+			if hex.EncodeToString(got[:]) != sum {
+				st.Consistent = false
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// readJSON decodes the JSON file at p into v, leaving v as it is if there's no
+// such file
+func readJSON(p string, v interface{}) error {
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil { return err }
+	err = json.Unmarshal(b, v)
+	if err != nil { return fmt.Errorf("bad %s: %v", p, err) }
+	return nil
+}
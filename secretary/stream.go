@@ -0,0 +1,175 @@
+package secretary
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ChunkSize is the most of a stream sealed into a single frame
+const ChunkSize = 64 << 10
+
+// a stream is sealed as frames, each chunk of ChunkSize but the last sealed with
+// its index in the stream and whether it's the last as additional data, so frames
+// can't be reordered, dropped or cut short without opening failing
+
+// streamAD is the additional data of frame i of a stream
+func streamAD(i uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, i)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// sealWriter seals what's written to it into frames written to dst; own is whether
+// shared is its own, to zero once it's closed
+type sealWriter struct{
+	dst io.Writer
+	shared *[32]byte
+	own bool
+	buf []byte
+	i uint64
+	err error
+}
+
+// NewSealWriter returns a writer sealing a stream from senderPrv to recipientPub
+// into frames written to dst, a chunk at a time; Close seals what's left as the
+// last chunk and zeroes the key it shares with the recipient, but doesn't close dst
+func NewSealWriter(dst io.Writer, recipientPub, senderPrv Key) io.WriteCloser {
+	sw := newSealWriter(dst, Precompute(recipientPub, senderPrv))
+	sw.own = true
+	return sw
+}
+
+// NewSealWriterPrecomputed is NewSealWriter with the key shared by sender and
+// recipient, as returned by Precompute; shared stays the caller's, to zero once
+// the writer is closed, Close leaves it as it is
+func NewSealWriterPrecomputed(dst io.Writer, shared *[32]byte) io.WriteCloser {
+	return newSealWriter(dst, shared)
+}
+
+func newSealWriter(dst io.Writer, shared *[32]byte) *sealWriter {
+	return &sealWriter{dst: dst, shared: shared, buf: make([]byte, 0, ChunkSize)}
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for sw.err == nil && len(p) > 0 {
+		// a full chunk is only sealed once there's more, as it may be the last
+		if len(sw.buf) == cap(sw.buf) {
+			sw.err = sw.flush(false)
+			continue
+		}
+		m := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, sw.err
+}
+
+// flush seals the buffered chunk into a frame
+func (sw *sealWriter) flush(last bool) error {
+	_, err := SealFrame(sw.dst, sw.buf, streamAD(sw.i, last), sw.shared)
+	Wipe(sw.buf)
+	sw.buf = sw.buf[:0]
+	sw.i++
+	return err
+}
+
+func (sw *sealWriter) Close() error {
+	if sw.err == nil {
+		sw.err = sw.flush(true)
+	}
+	if sw.own {
+		Zero(sw.shared)
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	sw.err = fmt.Errorf("write to closed seal writer")
+	return nil
+}
+
+// openReader reads the frames of src, opening them; own is whether shared is its
+// own, to zero once the whole stream is read
+type openReader struct{
+	src io.Reader
+	shared *[32]byte
+	own bool
+	frame []byte
+	buf []byte
+	i uint64
+	last bool
+}
+
+// NewOpenReader returns a reader of the stream sealed into the frames of src from
+// senderPub to recipientPrv, as by NewSealWriter, anything in src after the last
+// frame being an error; the key it shares with the sender is zeroed once it's read
+// to io.EOF, or once it's closed
+func NewOpenReader(src io.Reader, senderPub, recipientPrv Key) io.ReadCloser {
+	return &openReader{src: src, shared: Precompute(senderPub, recipientPrv), own: true}
+}
+
+// NewOpenReaderPrecomputed is NewOpenReader with the key shared by sender and
+// recipient, as returned by Precompute; shared stays the caller's, to zero once the
+// stream is read
+func NewOpenReaderPrecomputed(src io.Reader, shared *[32]byte) io.ReadCloser {
+	return &openReader{src: src, shared: shared}
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.buf) == 0 {
+		if or.last {
+			or.Close()
+			return 0, io.EOF
+		}
+		err := or.next()
+		if err != nil { return 0, err }
+	}
+	n := copy(p, or.buf)
+	or.buf = or.buf[n:]
+	return n, nil
+}
+
+// Close wipes what's left unread of the stream's last frame opened and, if it's its
+// own, the shared key; it doesn't close src
+func (or *openReader) Close() error {
+	Wipe(or.frame)
+	or.frame, or.buf = nil, nil
+	if or.own {
+		Zero(or.shared)
+	}
+	return nil
+}
+
+// next reads and opens the next frame, which is the last if it opens as such
+func (or *openReader) next() error {
+	Wipe(or.frame)
+	nonce, ciphertext, err := readFrame(or.src)
+	if err == io.EOF {
+		return fmt.Errorf("%w stream: no last frame after %d", ErrTruncated, or.i)
+	}
+	if err != nil { return err }
+	for _, last := range []bool{false, true} {
+		or.frame, err = openFrame(nonce, ciphertext, streamAD(or.i, last), or.shared)
+		if err == nil {
+			or.last = last
+			break
+		}
+	}
+	if err != nil { return fmt.Errorf("frame %d: %w", or.i, err) }
+	if or.last {
+		n, err := io.ReadFull(or.src, make([]byte, 1))
+		if n > 0 {
+			Wipe(or.frame)
+			return fmt.Errorf("bytes after the last frame %d", or.i)
+		}
+		if err != io.EOF { return err }
+	}
+	or.buf = or.frame
+	or.i++
+	return nil
+}
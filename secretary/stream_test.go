@@ -0,0 +1,136 @@
+package secretary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testKeys are a sender's and a recipient's keypairs
+func testKeys(t *testing.T) (senderPub, senderPrv, recipientPub, recipientPrv Key) {
+	t.Helper()
+	senderPub, senderPrv, err := GenerateKey()
+	if err != nil { t.Fatal(err) }
+	recipientPub, recipientPrv, err = GenerateKey()
+	if err != nil { t.Fatal(err) }
+	return senderPub, senderPrv, recipientPub, recipientPrv
+}
+
+// pattern is n bytes that aren't all alike
+func pattern(n int) []byte {
+	b := make([]byte, 0, n+sha256.Size)
+	for sum := sha256.Sum256(nil); len(b) < n; sum = sha256.Sum256(sum[:]) {
+		b = append(b, sum[:]...)
+	}
+	return b[:n]
+}
+
+// sealStream seals msg as a stream
+func sealStream(t *testing.T, msg []byte, recipientPub, senderPrv Key) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	sw := NewSealWriter(buf, recipientPub, senderPrv)
+	_, err := sw.Write(msg)
+	if err == nil {
+		err = sw.Close()
+	}
+	if err != nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func TestStreamPipe(t *testing.T) {
+	senderPub, senderPrv, recipientPub, recipientPrv := testKeys(t)
+	for _, n := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3<<20 + 17} {
+		msg := pattern(n)
+		pr, pw := io.Pipe()
+		go func() {
+			sw := NewSealWriter(pw, recipientPub, senderPrv)
+			// odd sized writes, so chunks are made of several
+			var err error
+			for p := msg; len(p) > 0 && err == nil; {
+				m := 1000
+				if m > len(p) {
+					m = len(p)
+				}
+				_, err = sw.Write(p[:m])
+				p = p[m:]
+			}
+			if err == nil {
+				err = sw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		got, err := ioutil.ReadAll(NewOpenReader(pr, senderPub, recipientPrv))
+		if err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		} else if !bytes.Equal(got, msg) {
+			t.Errorf("%d bytes: opened %d bytes that aren't what was sealed", n, len(got))
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	senderPub, senderPrv, recipientPub, recipientPrv := testKeys(t)
+	sealed := sealStream(t, pattern(2*ChunkSize+5), recipientPub, senderPrv)
+	frame := FrameOverhead + ChunkSize
+	if len(sealed) != 2*frame+FrameOverhead+5 {
+		t.Fatalf("sealed %d bytes", len(sealed))
+	}
+	swapped := append(append(append([]byte{}, sealed[frame:2*frame]...), sealed[:frame]...), sealed[2*frame:]...)
+	flipped := append([]byte{}, sealed...)
+	flipped[frame+100] ^= 1
+
+	for _, c := range []struct{
+		name string
+		sealed []byte
+		want error
+	}{
+		{"without its last frame", sealed[:2*frame], ErrTruncated},
+		{"cut short", sealed[:len(sealed)-1], ErrTruncated},
+		{"with frames swapped", swapped, ErrAuthFailed},
+		{"with a byte flipped", flipped, ErrAuthFailed},
+		{"with a byte after it", append(append([]byte{}, sealed...), 0), nil},
+	} {
+		_, err := ioutil.ReadAll(NewOpenReader(bytes.NewReader(c.sealed), senderPub, recipientPrv))
+		switch {
+		case err == nil:
+			t.Errorf("a stream %s opened", c.name)
+		case c.want != nil && !errors.Is(err, c.want):
+			t.Errorf("a stream %s: %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestStreamKeys(t *testing.T) {
+	senderPub, senderPrv, recipientPub, recipientPrv := testKeys(t)
+	shared := Precompute(recipientPub, senderPrv)
+	want := *shared
+	buf := &bytes.Buffer{}
+	sw := NewSealWriterPrecomputed(buf, shared)
+	_, err := sw.Write([]byte("msg"))
+	if err == nil {
+		err = sw.Close()
+	}
+	if err != nil { t.Fatal(err) }
+	if *shared != want {
+		t.Errorf("closing a precomputed seal writer changed the caller's key")
+	}
+
+	or := NewOpenReader(bytes.NewReader(buf.Bytes()), senderPub, recipientPrv)
+	got, err := ioutil.ReadAll(or)
+	if err != nil || string(got) != "msg" { t.Fatalf("opened %q: %v", got, err) }
+	if *or.(*openReader).shared != [32]byte{} {
+		t.Errorf("the open reader's own key isn't zeroed at io.EOF")
+	}
+
+	shared = Precompute(senderPub, recipientPrv)
+	or = NewOpenReaderPrecomputed(bytes.NewReader(buf.Bytes()), shared)
+	_, err = ioutil.ReadAll(or)
+	if err != nil { t.Fatal(err) }
+	if *shared != want {
+		t.Errorf("reading a precomputed open reader to io.EOF changed the caller's key")
+	}
+}
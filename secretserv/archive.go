@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// an archive of -export is a tar of the files of crypt/ under crypt/, but for
+// .lock and temporary files, and of the metadata in secret/ of every file of the
+// digest under meta/, which is all it takes to decrypt them elsewhere
+const (
+	archiveCrypt = "crypt/"
+	archiveMeta = "meta/"
+)
+
+// exportCrypt writes the archive of crypt/ to the file at p, holding the lock so no
+// serv changes crypt/ as it's read
+func exportCrypt(p string) error {
+	err := acquireLock()
+	if err != nil { return err }
+	defer releaseLock()
+
+	files := []string{}
+	err = filepath.WalkDir(cryptDir, func(q string, de fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if de.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(cryptDir, q)
+		if err != nil { return err }
+		rel = filepath.ToSlash(rel)
+		if rel == ".lock" || strings.HasPrefix(path.Base(rel), tmpPrefix) {
+			return nil
+		}
+		if !de.Type().IsRegular() {
+			return fmt.Errorf("%s isn't a regular file", q)
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil { return err }
+	digest, err := loadDigest()
+	if err != nil { return err }
+	names := []string{}
+	for name := range digest.Snapshot() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err = atomicWriteFrom(p, 0600, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		for _, rel := range files {
+			err := archiveFile(tw, archiveCrypt+rel, filepath.Join(cryptDir, filepath.FromSlash(rel)))
+			if err != nil { return err }
+		}
+		for _, name := range names {
+			err := archiveFile(tw, archiveMeta+name+".meta.json", metaPath(name))
+			if err != nil { return err }
+		}
+		return tw.Close()
+	})
+	if err != nil { return err }
+	logf(normal, "exported %d files of %s and %d metadata to %s\n", len(files), cryptDir, len(names), p)
+	return nil
+}
+
+// archiveFile writes the file at p to tw as name
+func archiveFile(tw *tar.Writer, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil { return err }
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil { return err }
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Mode: 0600,
+		Size: fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil { return err }
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// archiveName is the path relative to crypt/ or secret/ of the file name of an
+// archive, refusing any that would land outside them or on serv's own files
+func archiveName(name string) (rel string, meta bool, err error) {
+	switch {
+	case strings.HasPrefix(name, archiveCrypt):
+		rel = strings.TrimPrefix(name, archiveCrypt)
+	case strings.HasPrefix(name, archiveMeta):
+		rel, meta = strings.TrimPrefix(name, archiveMeta), true
+	default:
+		return "", false, fmt.Errorf("%s is neither in %s nor %s", name, archiveCrypt, archiveMeta)
+	}
+	if rel == "" || path.IsAbs(rel) || path.Clean(rel) != rel || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false, fmt.Errorf("bad name %s", name)
+	}
+	if strings.HasPrefix(path.Base(rel), tmpPrefix) || !meta && rel == ".lock" || meta && !strings.HasSuffix(rel, ".meta.json") {
+		return "", false, fmt.Errorf("%s doesn't belong in an archive", name)
+	}
+	return rel, meta, nil
+}
+
+// importCrypt restores crypt/ and the metadata of its files from the archive at p,
+// as written by exportCrypt; crypt/ must be empty and the metadata not there yet,
+// but with force, which keeps what crypt/ had in crypt.bak and the metadata it
+// replaces in crypt.bak.meta, as they were in secret/, so what was there before
+// can still be decrypted
+//
+// the archive is unpacked into crypt/ and secret/ first, each apart from what they
+// hold, checking each chunk against its checksum, so an archive that's damaged is
+// refused before either is touched and every file is then only renamed within its
+// own filesystem; should any rename still fail, crypt.bak on another filesystem for
+// one, those made are undone and crypt/ and secret/ are left as they were
+func importCrypt(p string, force bool) (err error) {
+	err = os.MkdirAll(cryptDir, 0700)
+	if err != nil { return err }
+	err = acquireLock()
+	if err != nil { return err }
+	defer releaseLock()
+
+	old, err := cryptEntries()
+	if err != nil { return err }
+	if len(old) > 0 && !force {
+		return fmt.Errorf("%s isn't empty, -force to replace it", cryptDir)
+	}
+
+	cryptStaging, err := ioutil.TempDir(cryptDir, tmpPrefix+"import.")
+	if err != nil { return err }
+	defer os.RemoveAll(cryptStaging)
+	secretStaging, err := ioutil.TempDir(secretDir, tmpPrefix+"import.")
+	if err != nil { return err }
+	defer os.RemoveAll(secretStaging)
+	metas, chunks, err := unpack(p, cryptStaging, filepath.Join(secretStaging, "meta"))
+	if err != nil { return fmt.Errorf("%s: %v", p, err) }
+	replaced := []string{}
+	for _, name := range metas {
+		if _, err := os.Lstat(filepath.Join(secretDir, filepath.FromSlash(name))); err == nil {
+			if !force {
+				return fmt.Errorf("%s is already in %s, -force to replace it", name, secretDir)
+			}
+			replaced = append(replaced, name)
+		}
+	}
+
+	// both backups are made before either is moved into, so neither is left half
+	// made by the other already being there; the metadata is copied into its
+	// backup, which may well be on another filesystem than secret/
+	bak, metaBak := filepath.Clean(cryptDir)+".bak", filepath.Clean(cryptDir)+".bak.meta"
+	rs := renames{}
+	var madeBak, madeMetaBak bool
+	defer func() {
+		if err == nil {
+			return
+		}
+		rs.undo()
+		// crypt.bak is empty once undone, unless undoing failed too, and
+		// crypt.bak.meta holds only copies
+		if madeBak {
+			os.Remove(bak)
+		}
+		if madeMetaBak {
+			os.RemoveAll(metaBak)
+		}
+	}()
+	if len(old) > 0 {
+		err = os.Mkdir(bak, 0700)
+		if err != nil { return err }
+		madeBak = true
+	}
+	if len(replaced) > 0 {
+		err = os.Mkdir(metaBak, 0700)
+		if err != nil { return err }
+		madeMetaBak = true
+	}
+	for _, name := range replaced {
+		q := filepath.Join(metaBak, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(q), 0700)
+		if err != nil { return err }
+		b, err := ioutil.ReadFile(filepath.Join(secretDir, filepath.FromSlash(name)))
+		if err == nil {
+			err = atomicWrite(q, b, 0600)
+		}
+		if err != nil { return err }
+	}
+
+	for _, name := range old {
+		err = rs.rename(filepath.Join(cryptDir, name), filepath.Join(bak, name))
+		if err != nil { return err }
+	}
+	for _, name := range replaced {
+		err = rs.rename(filepath.Join(secretDir, filepath.FromSlash(name)), filepath.Join(secretStaging, "replaced", filepath.FromSlash(name)))
+		if err != nil { return err }
+	}
+	entries, err := ioutil.ReadDir(cryptStaging)
+	if err != nil { return err }
+	for _, fi := range entries {
+		err = rs.rename(filepath.Join(cryptStaging, fi.Name()), filepath.Join(cryptDir, fi.Name()))
+		if err != nil { return err }
+	}
+	for _, name := range metas {
+		err = rs.rename(filepath.Join(secretStaging, "meta", filepath.FromSlash(name)), filepath.Join(secretDir, filepath.FromSlash(name)))
+		if err != nil { return err }
+	}
+
+	if len(old) > 0 {
+		logf(normal, "kept what %s had in %s\n", cryptDir, bak)
+	}
+	if len(replaced) > 0 {
+		logf(normal, "kept the %d metadata replaced in %s\n", len(replaced), metaBak)
+	}
+	logf(normal, "imported %d chunks into %s and %d metadata into %s\n", chunks, cryptDir, len(metas), secretDir)
+	return nil
+}
+
+// rename is os.Rename, but for tests failing one as a rename across filesystems does
+var rename = os.Rename
+
+// renames are the renames an import has made, to undo should a later one fail
+type renames [][2]string
+
+// rename renames from to to, making the directory it's in, and records it
+func (rs *renames) rename(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0700)
+	if err == nil {
+		err = rename(from, to)
+	}
+	if err != nil { return err }
+	*rs = append(*rs, [2]string{from, to})
+	return nil
+}
+
+// undo renames back everything renamed, last first
+func (rs renames) undo() {
+	for i := len(rs) - 1; i >= 0; i-- {
+		err := os.Rename(rs[i][1], rs[i][0])
+		if err != nil {
+			logf(quiet, "undoing the import: %v\n", err)
+		}
+	}
+}
+
+// cryptEntries are the entries of crypt/ but its lock
+func cryptEntries() ([]string, error) {
+	fis, err := ioutil.ReadDir(cryptDir)
+	if err != nil { return nil, err }
+	names := []string{}
+	for _, fi := range fis {
+		if fi.Name() != ".lock" {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// unpack unpacks the archive at p, its crypt/ files into cryptTo and its metadata
+// into metaTo, returning the names of the metadata and how many chunks there were;
+// a chunk that doesn't match its checksum is an error
+func unpack(p, cryptTo, metaTo string) (metas []string, chunks int, err error) {
+	f, err := os.Open(p)
+	if err != nil { return nil, 0, err }
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil { return nil, 0, err }
+		if h.Typeflag != tar.TypeReg {
+			return nil, 0, fmt.Errorf("%s isn't a regular file", h.Name)
+		}
+		rel, meta, err := archiveName(h.Name)
+		if err != nil { return nil, 0, err }
+		dir := cryptTo
+		if meta {
+			dir = metaTo
+			metas = append(metas, rel)
+		}
+		q := filepath.Join(dir, filepath.FromSlash(rel))
+		err = os.MkdirAll(filepath.Dir(q), 0700)
+		if err != nil { return nil, 0, err }
+		out, err := os.OpenFile(q, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil { return nil, 0, err }
+		h256 := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h256), tr)
+		if err == nil {
+			err = out.Close()
+		} else {
+			out.Close()
+		}
+		if err != nil { return nil, 0, err }
+		os.Chtimes(q, time.Now(), h.ModTime)
+		if !meta && isChunkName(path.Base(rel)) {
+			if hex.EncodeToString(h256.Sum(nil)) != path.Base(rel) {
+				return nil, 0, fmt.Errorf("chunk %s doesn't match its checksum", rel)
+			}
+			chunks++
+		}
+	}
+	return metas, chunks, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestImportForce(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "f", []byte("exported"))
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	archive := filepath.Join(t.TempDir(), "crypt.tar")
+	err = exportCrypt(archive)
+	if err != nil { t.Fatal(err) }
+	exported, err := ioutil.ReadFile(metaPath("f"))
+	if err != nil { t.Fatal(err) }
+
+	// f changes, and is encrypted again, before the archive is imported over it
+	writeSecret(t, "f", []byte("encrypted since"))
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	since, err := ioutil.ReadFile(metaPath("f"))
+	if err != nil { t.Fatal(err) }
+
+	err = importCrypt(archive, false)
+	if err == nil {
+		t.Fatalf("imported over a crypt/ that isn't empty without -force")
+	}
+	err = importCrypt(archive, true)
+	if err != nil { t.Fatal(err) }
+	got, err := decryptFile("f")
+	if err != nil || string(got) != "exported" {
+		t.Errorf("decrypted %q once imported: %v", got, err)
+	}
+	b, err := ioutil.ReadFile(metaPath("f"))
+	if err != nil || !bytes.Equal(b, exported) {
+		t.Errorf("the metadata imported isn't what was exported: %v", err)
+	}
+
+	// what was replaced decrypts from the backups
+	b, err = ioutil.ReadFile(filepath.Join(cryptDir+".bak.meta", "f.meta.json"))
+	if err != nil || !bytes.Equal(b, since) {
+		t.Fatalf("the metadata replaced isn't in crypt.bak.meta: %v", err)
+	}
+	dir := filepath.Dir(secretDir)
+	err = os.Rename(cryptDir, filepath.Join(dir, "imported"))
+	if err == nil {
+		err = os.Rename(cryptDir+".bak", cryptDir)
+	}
+	if err == nil {
+		err = os.Rename(filepath.Join(cryptDir+".bak.meta", "f.meta.json"), metaPath("f"))
+	}
+	if err != nil { t.Fatal(err) }
+	got, err = decryptFile("f")
+	if err != nil || string(got) != "encrypted since" {
+		t.Errorf("decrypted %q from the backups: %v", got, err)
+	}
+}
+
+func TestImportDamaged(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "f", noise(3*chunkSize))
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	// export doesn't check chunks, a damaged one is archived as it is
+	p := chunkPath("f", s.manifest["f"][1])
+	b, err := ioutil.ReadFile(p)
+	if err == nil {
+		b[10] ^= 1
+		err = ioutil.WriteFile(p, b, 0600)
+	}
+	if err != nil { t.Fatal(err) }
+	archive := filepath.Join(t.TempDir(), "crypt.tar")
+	err = exportCrypt(archive)
+	if err != nil { t.Fatal(err) }
+	before, err := cryptEntries()
+	if err != nil { t.Fatal(err) }
+
+	err = importCrypt(archive, true)
+	if err == nil {
+		t.Fatalf("imported a damaged archive")
+	}
+	after, err := cryptEntries()
+	if err != nil || len(after) != len(before) {
+		t.Errorf("crypt/ changed importing a damaged archive: %q, was %q", after, before)
+	}
+	if _, err := os.Stat(cryptDir + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("crypt.bak made importing a damaged archive: %v", err)
+	}
+}
+
+// TestImportUndone checks that an import failing part way, as it would renaming
+// across filesystems, leaves crypt/ and secret/ as they were
+func TestImportUndone(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "f", []byte("exported"))
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	archive := filepath.Join(t.TempDir(), "crypt.tar")
+	err = exportCrypt(archive)
+	if err != nil { t.Fatal(err) }
+	writeSecret(t, "f", []byte("encrypted since"))
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	since, err := ioutil.ReadFile(metaPath("f"))
+	if err != nil { t.Fatal(err) }
+	before, err := cryptEntries()
+	if err != nil { t.Fatal(err) }
+
+	// the metadata is renamed into secret/ last, once crypt/ is all replaced
+	defer func() { rename = os.Rename }()
+	rename = func(from, to string) error {
+		if to == metaPath("f") {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+		}
+		return os.Rename(from, to)
+	}
+	err = importCrypt(archive, true)
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Fatalf("import renaming across filesystems: %v, want %v", err, syscall.EXDEV)
+	}
+	after, err := cryptEntries()
+	if err != nil || !reflect.DeepEqual(after, before) {
+		t.Errorf("crypt/ has %q once the import is undone, had %q: %v", after, before, err)
+	}
+	b, err := ioutil.ReadFile(metaPath("f"))
+	if err != nil || !bytes.Equal(b, since) {
+		t.Errorf("the metadata isn't what it was once the import is undone: %v", err)
+	}
+	for _, p := range []string{cryptDir + ".bak", cryptDir + ".bak.meta"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left by the import undone: %v", p, err)
+		}
+	}
+	if staged, _ := filepath.Glob(filepath.Join(secretDir, tmpPrefix+"*")); len(staged) > 0 {
+		t.Errorf("%q left in secret/ by the import undone", staged)
+	}
+	got, err := decryptFile("f")
+	if err != nil || string(got) != "encrypted since" {
+		t.Errorf("decrypted %q once the import is undone: %v", got, err)
+	}
+}
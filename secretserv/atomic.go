@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tmpPrefix begins the name of every temporary file atomicWrite creates
+const tmpPrefix = ".serv-tmp-"
+
+// atomicWrite writes data to path through a temporary file in the same directory,
+// renamed over path once complete, so a crash mid-write leaves either the old file
+// or the new one but never a truncated mix
+//
+// the temporary file must be in the same directory, a rename is only atomic within
+// a single filesystem
+func atomicWrite(path string, data []byte, perm os.FileMode) error {
+	return atomicWriteFrom(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// atomicWriteFrom is atomicWrite of what write writes, for data that's streamed
+// rather than in memory; path is left untouched if write fails
+func atomicWriteFrom(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), tmpPrefix+filepath.Base(path)+".")
+	if err != nil { return err }
+	defer os.Remove(f.Name())
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil { return err }
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditEntry is a line of crypt/audit.log under -audit, recording one operation on
+// a file of secret/
+//
+// Prev is the sha256 of the line before, so the lines form a chain: a line edited,
+// removed or inserted breaks it at the next line. The chain carries on across
+// rotations, the first line of a log follows the last of the log rotated before
+// it. The chain alone can't tell the whole of it was written again, the head
+// -verify-audit reports is to be kept outside crypt/ for that
+type auditEntry struct{
+	Time time.Time `json:"time"`
+	File string `json:"file"`
+	Action string `json:"action"`
+	Checksum string `json:"checksum,omitempty"`
+	Actor string `json:"actor"`
+	Error string `json:"error,omitempty"`
+	Prev string `json:"prev"`
+}
+
+// auditMax is the size from which crypt/audit.log is rotated to crypt/audit.log.N
+// before another line is appended, N one more than the log rotated before
+const auditMax = 8 << 20
+
+// auditHead is the sha256 of the last line of the chain, read from the logs when
+// first needed; only the serv holding the lock appends to them
+var auditHead *string
+
+// auditLogs lists the rotated logs of crypt/, oldest first
+func auditLogs() ([]string, error) {
+	paths, err := filepath.Glob(auditPath() + ".*")
+	if err != nil { return nil, err }
+	logs := []string{}
+	nums := map[string]int{}
+	for _, p := range paths {
+		n, err := strconv.Atoi(strings.TrimPrefix(p, auditPath()+"."))
+		if err != nil || n < 1 {
+			continue
+		}
+		nums[p] = n
+		logs = append(logs, p)
+	}
+	sort.Slice(logs, func(i, j int) bool { return nums[logs[i]] < nums[logs[j]] })
+	return logs, nil
+}
+
+// lineHash is the hash of a line of the log, without its newline
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// walkAudit calls fn with each line of every log, oldest first, with its log and
+// number; it's the chain of them all, rotated ones before crypt/audit.log
+func walkAudit(fn func(path string, n int, line []byte) error) error {
+	logs, err := auditLogs()
+	if err != nil { return err }
+	logs = append(logs, auditPath())
+	for _, p := range logs {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil { return err }
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for n := 1; sc.Scan(); n++ {
+			err = fn(p, n, sc.Bytes())
+			if err != nil { break }
+		}
+		if err == nil {
+			err = sc.Err()
+		}
+		f.Close()
+		if err != nil { return err }
+	}
+	return nil
+}
+
+// auditActor is who what's audited is done by: whoever runs serv, and where
+func auditActor() string {
+	name := "?"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "?"
+	}
+	return name + "@" + host
+}
+
+// audit appends e to crypt/audit.log, chained to the line before it
+func audit(e auditEntry) error {
+	if auditHead == nil {
+		head := ""
+		err := walkAudit(func(_ string, _ int, line []byte) error {
+			head = lineHash(line)
+			return nil
+		})
+		if err != nil { return err }
+		auditHead = &head
+	}
+	if fi, err := os.Stat(auditPath()); err == nil && fi.Size() >= auditMax {
+		logs, err := auditLogs()
+		if err != nil { return err }
+		n := 1
+		if len(logs) > 0 {
+			n, _ = strconv.Atoi(strings.TrimPrefix(logs[len(logs)-1], auditPath()+"."))
+			n++
+		}
+		err = os.Rename(auditPath(), fmt.Sprintf("%s.%d", auditPath(), n))
+		if err != nil { return err }
+	}
+
+	e.Time = e.Time.UTC()
+	e.Actor = auditActor()
+	e.Prev = *auditHead
+	b, err := json.Marshal(&e)
+	if err != nil { return err }
+	f, err := os.OpenFile(auditPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil { return err }
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil { return err }
+	*auditHead = lineHash(b)
+	return nil
+}
+
+// auditResult audits r, if it encrypted its file or failed to; unchanged files are
+// left out, a scan would log every file of secret/
+func (s *serv) auditResult(r result) {
+	if !s.audit || r.err == nil && !r.encrypted {
+		return
+	}
+	e := auditEntry{Time: time.Now(), File: r.name, Action: "encrypted"}
+	if r.sum != ([32]byte{}) {
+		e.Checksum = hex.EncodeToString(r.sum[:])
+	}
+	if r.err != nil {
+		e.Action = "error"
+		e.Error = r.err.Error()
+	}
+	s.auditOrWarn(e)
+}
+
+// auditOrWarn audits e under -audit, warning if it can't, which doesn't stop what
+// it audits
+func (s *serv) auditOrWarn(e auditEntry) {
+	if !s.audit {
+		return
+	}
+	err := audit(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: not audited, %s %s: %v\n", e.Action, e.File, err)
+	}
+}
+
+// verifyAudit walks the chain of the audit logs, reporting to w where it's broken,
+// if anywhere, and otherwise how many lines it has and the hash of the last, its
+// head, which is to be kept outside crypt/ to compare against later
+func verifyAudit(w io.Writer) (bool, error) {
+	prev := ""
+	var lines int
+	var broken []string
+	err := walkAudit(func(path string, n int, line []byte) error {
+		lines++
+		e := auditEntry{}
+		d := json.NewDecoder(bytes.NewReader(line))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&e); err != nil {
+			broken = append(broken, fmt.Sprintf("%s:%d: bad line: %v", path, n, err))
+		} else if e.Prev != prev {
+			broken = append(broken, fmt.Sprintf("%s:%d: doesn't follow the line before, edited or removed", path, n))
+		}
+		prev = lineHash(line)
+		return nil
+	})
+	if err != nil { return false, err }
+	for _, b := range broken {
+		fmt.Fprintln(w, b)
+	}
+	if len(broken) > 0 {
+		fmt.Fprintf(w, "audit log is broken in %d places of %d lines\n", len(broken), lines)
+		return false, nil
+	}
+	fmt.Fprintf(w, "audit log is intact: %d lines, head %s\n", lines, prev)
+	return true, nil
+}
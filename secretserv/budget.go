@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// budget bounds the bytes of the files being encrypted at once, so a scan of many
+// large files doesn't hold more of them than a memory-constrained host has
+//
+// files are read a chunk at a time, but sized by the whole file the budget also
+// bounds what compression and the page cache are asked to hold; a file larger than
+// the whole budget takes all of it, waiting for every other to finish first
+type budget struct{
+	mu sync.Mutex
+	cond *sync.Cond
+	max, used int64
+}
+
+// newBudget returns a budget of max bytes, or nil for no budget
+func newBudget(max int64) *budget {
+	if max <= 0 {
+		return nil
+	}
+	b := &budget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes of b are free and takes them, returning how many it
+// took, to be given back to release
+func (b *budget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	if n > b.max {
+		n = b.max
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// release gives back n bytes taken by acquire
+func (b *budget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// fileSize is the size of name in secret/, 0 if it can't be told, for check
+// to fail on
+func (s *serv) fileSize(name string) int64 {
+	fi, err := s.statSecret(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	const max = 100
+	b := newBudget(max)
+	mu := sync.Mutex{}
+	var held, peak int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			n := b.acquire(size)
+			mu.Lock()
+			held += n
+			if held > peak {
+				peak = held
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			held -= n
+			mu.Unlock()
+			b.release(n)
+		}(int64(i * 7 % 130))
+	}
+	wg.Wait()
+	if peak > max {
+		t.Errorf("peak of %d bytes held, over the budget of %d", peak, max)
+	}
+	if b.used != 0 {
+		t.Errorf("%d bytes still used once all are released", b.used)
+	}
+	if n := b.acquire(max + 1); n != max {
+		t.Errorf("file larger than the budget took %d, want all %d", n, max)
+	}
+	b.release(max)
+
+	var none *budget
+	if n := none.acquire(1 << 40); n != 0 {
+		t.Errorf("no budget took %d", n)
+	}
+	none.release(0)
+}
+
+// TestScanBudget checks a scan of files larger together than the budget never holds
+// more of them than it at once
+func TestScanBudget(t *testing.T) {
+	s := newTestServ(t)
+	s.jobs = 4
+	max := int64(3 * chunkSize)
+	s.inFlight = newBudget(max)
+	for i := 0; i < 12; i++ {
+		writeSecret(t, fmt.Sprintf("f%d", i), noise(chunkSize/2+i*chunkSize/4))
+	}
+
+	var peak int64
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			s.inFlight.mu.Lock()
+			if s.inFlight.used > peak {
+				peak = s.inFlight.used
+			}
+			s.inFlight.mu.Unlock()
+			select {
+			case <-stop:
+				return
+			default:
+				time.Sleep(10 * time.Microsecond)
+			}
+		}
+	}()
+	err := s.scan(context.Background())
+	close(stop)
+	<-polled
+	if err != nil { t.Fatal(err) }
+	if peak > max {
+		t.Errorf("peak of %d bytes in flight, over the budget of %d", peak, max)
+	}
+	if peak == 0 {
+		t.Errorf("nothing seen in flight")
+	}
+	for i := 0; i < 12; i++ {
+		if _, ok := s.digest.Get(fmt.Sprintf("f%d", i)); !ok {
+			t.Errorf("f%d not encrypted", i)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// chunkDiff reports to w how the chunks name was last encrypted into differ from
+// those of the encryption before: how many were added and removed, and how many
+// retained, deduplicated rather than stored again; with fixed chunks only those
+// ahead of an edit are retained, with -cdc all but those around it
+//
+// it only reads the manifests, chunks are compared by their sums and nothing is
+// decrypted
+func chunkDiff(name string, w io.Writer) error {
+	digest, err := loadDigest()
+	if err != nil { return err }
+	manifest, err := loadManifest(digest)
+	if err != nil { return err }
+	cur, ok := manifest[name]
+	if !ok {
+		return fmt.Errorf("%s isn't in %s", name, manifestPath())
+	}
+	previous, err := loadPrevious()
+	if err != nil { return err }
+	prev, ok := previous[name]
+	if !ok {
+		return fmt.Errorf("%s was only encrypted once since %s was kept", name, previousPath())
+	}
+
+	before := map[string]bool{}
+	for _, sum := range prev {
+		before[sum] = true
+	}
+	now := map[string]bool{}
+	var added, retained int
+	for _, sum := range cur {
+		if now[sum] {
+			continue
+		}
+		now[sum] = true
+		if before[sum] {
+			retained++
+		} else {
+			added++
+		}
+	}
+	removed := len(before) - retained
+
+	fmt.Fprintf(w, "%s: %d chunks, %d before\n", name, len(now), len(before))
+	fmt.Fprintf(w, "added %d, removed %d, retained %d\n", added, removed, retained)
+	ratio := 0.0
+	if len(now) > 0 {
+		ratio = float64(retained) / float64(len(now))
+	}
+	fmt.Fprintf(w, "dedup ratio %.1f%%, of its chunks only the %d added were stored again\n", 100*ratio, added)
+	return nil
+}
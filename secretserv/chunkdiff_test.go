@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChunkDiff(t *testing.T) {
+	s := newTestServ(t)
+	s.cdc = &cdc{min: 1 << 10, avg: 4 << 10, max: 16 << 10}
+	orig := noise(256 << 10)
+	edited := append(append(append([]byte{}, orig[:len(orig)/2]...), "edit"...), orig[len(orig)/2:]...)
+	for _, b := range [][]byte{orig, edited} {
+		writeSecret(t, "f", b)
+		err := s.encrypt("f")
+		if err != nil { t.Fatal(err) }
+	}
+	w := &bytes.Buffer{}
+	err := chunkDiff("f", w)
+	if err != nil { t.Fatal(err) }
+
+	var now, before, added, removed, retained int
+	_, err = fmt.Sscanf(w.String(), "f: %d chunks, %d before\nadded %d, removed %d, retained %d\n", &now, &before, &added, &removed, &retained)
+	if err != nil { t.Fatalf("%v in %q", err, w) }
+	if added+retained != now || removed+retained != before {
+		t.Errorf("counts don't add up: %q", w)
+	}
+	// an insertion changes the chunk it's in and at most the one after
+	if added < 1 || added > 2 || retained < now-2 {
+		t.Errorf("added %d and retained %d of %d chunks after one insertion", added, retained, now)
+	}
+	if !strings.Contains(w.String(), "dedup ratio") {
+		t.Errorf("no dedup ratio in %q", w)
+	}
+}
+
+func TestChunkDiffOnce(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "f", []byte("once"))
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	err = chunkDiff("f", &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "only encrypted once") {
+		t.Errorf("chunkdiff of a file encrypted once: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// cdc splits a file into content-defined chunks of min to max bytes, averaging avg,
+// cut wherever a gear hash of the last 64 bytes has its top log2(avg) bits zero,
+// so an edit only moves the boundaries near it rather than every one after it
+//
+// the next version of a file keeps the chunks of crypt/ the version before has at
+// the same index in the file, see encryptFile; with content-defined boundaries,
+// those an edit leaves alone are still at it unless the edit adds or drops a chunk
+// before them, and each chunk is compressed on its own so nor does it change how
+// the others compress
+type cdc struct{
+	min, avg, max int
+}
+
+// gear maps each byte to a random-looking 64 bit value, fixed so that the same
+// contents are always cut in the same places
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+func newCDC(min, avg, max int) (*cdc, error) {
+	if max > secretary.MaxFrameSize-secretary.FrameOverhead {
+		return nil, fmt.Errorf("bad chunk sizes: max %d is larger than a frame holds", max)
+	}
+	if min < 1 || min > avg || avg > max || avg&(avg-1) != 0 {
+		return nil, fmt.Errorf("bad chunk sizes: min %d, avg %d, max %d, want min <= avg <= max and avg a power of 2", min, avg, max)
+	}
+	return &cdc{min: min, avg: avg, max: max}, nil
+}
+
+// next reads the next chunk of r into buf, which holds at least c.max bytes,
+// returning its length; it's io.EOF once r is exhausted
+func (c *cdc) next(r io.ByteReader, buf []byte) (int, error) {
+	bits := uint(0)
+	for 1<<bits < c.avg {
+		bits++
+	}
+	var h uint64
+	n := 0
+	for n < c.max {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+		if err != nil { return 0, err }
+		buf[n] = b
+		n++
+		h = h<<1 + gear[b]
+		if n >= c.min && h>>(64-bits) == 0 {
+			break
+		}
+	}
+	return n, nil
+}
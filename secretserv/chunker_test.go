@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+// BenchmarkDedup encrypts a file, then again once a few bytes are inserted in its
+// middle, reporting the share of the edited file's chunks kept from before, with
+// fixed chunks and content-defined ones
+func BenchmarkDedup(b *testing.B) {
+	chunkings := []struct{
+		name string
+		cdc *cdc
+	}{
+		{"fixed", nil},
+		{"cdc", &cdc{min: 16 << 10, avg: 64 << 10, max: 256 << 10}},
+	}
+	for _, c := range chunkings {
+		b.Run(c.name, func(b *testing.B) {
+			s := newTestServ(b)
+			s.cdc = c.cdc
+			orig := noise(4 << 20)
+			edited := append(append(append([]byte{}, orig[:len(orig)/2]...), "edit"...), orig[len(orig)/2:]...)
+			b.SetBytes(int64(len(edited)))
+			var kept, chunks int
+			for i := 0; i < b.N; i++ {
+				writeSecret(b, "f", orig)
+				err := s.encrypt("f")
+				if err != nil { b.Fatal(err) }
+				before := map[string]bool{}
+				for _, sum := range s.manifest["f"] {
+					before[sum] = true
+				}
+				writeSecret(b, "f", edited)
+				err = s.encrypt("f")
+				if err != nil { b.Fatal(err) }
+				for _, sum := range s.manifest["f"] {
+					if before[sum] {
+						kept++
+					}
+				}
+				chunks += len(s.manifest["f"])
+			}
+			b.ReportMetric(100*float64(kept)/float64(chunks), "%kept")
+		})
+	}
+}
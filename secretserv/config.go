@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is what a -config file may set, as JSON with the names of the flags it
+// stands for; a field left out or zero leaves its flag's default, and a flag given
+// on the command line wins over the file
+type Config struct{
+	SecretDir string `json:"secret-dir"`
+	CryptDir string `json:"crypt-dir"`
+	Jobs int `json:"jobs"`
+	MaxInFlight int64 `json:"max-inflight"`
+	Batch string `json:"batch"`
+	Settle string `json:"settle"`
+	Compress *bool `json:"compress"`
+	TrustMtime bool `json:"trust-mtime"`
+	FollowSymlinks bool `json:"follow-symlinks"`
+	CDC bool `json:"cdc"`
+	ChunkMin int `json:"chunk-min"`
+	ChunkAvg int `json:"chunk-avg"`
+	ChunkMax int `json:"chunk-max"`
+	KDFTime uint `json:"kdf-time"`
+	KDFMemory uint `json:"kdf-memory"`
+	KDFThreads uint `json:"kdf-threads"`
+	Escrow string `json:"escrow"`
+	Recipients string `json:"recipients"`
+	RecipientsDir string `json:"recipients-dir"`
+	KeyFormat string `json:"key-format"`
+	KeyProvider string `json:"key-provider"`
+	LogJSON bool `json:"log-json"`
+	Progress bool `json:"progress"`
+	Audit bool `json:"audit"`
+	MetricsAddr string `json:"metrics-addr"`
+	InsecurePerms bool `json:"insecure-perms"`
+	// Ignore are patterns of files not to encrypt, as if in secret/.serveignore
+	Ignore []string `json:"ignore"`
+}
+
+// configIgnore are the Ignore patterns of -config, kept by loadIgnore along with
+// those of secret/.serveignore
+var configIgnore ignoreRules
+
+// loadConfig reads the Config at path, refusing fields it doesn't know as they're
+// most likely misspelled
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+	c := &Config{}
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	err = d.Decode(c)
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil { return nil, fmt.Errorf("bad %s: %v", path, err) }
+	return c, nil
+}
+
+// validate checks what c sets could be given as flags
+func (c *Config) validate() error {
+	if c.Jobs < 0 {
+		return fmt.Errorf("jobs %d is negative", c.Jobs)
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("max-inflight %d is negative", c.MaxInFlight)
+	}
+	if c.ChunkMin < 0 || c.ChunkAvg < 0 || c.ChunkMax < 0 {
+		return fmt.Errorf("chunk sizes %d, %d, %d include a negative one", c.ChunkMin, c.ChunkAvg, c.ChunkMax)
+	}
+	if c.ChunkMin > 0 && c.ChunkMax > 0 && c.ChunkMin > c.ChunkMax {
+		return fmt.Errorf("chunk-min %d is larger than chunk-max %d", c.ChunkMin, c.ChunkMax)
+	}
+	if c.KDFThreads > 255 {
+		return fmt.Errorf("kdf-threads %d is more than 255", c.KDFThreads)
+	}
+	if c.Batch != "" {
+		d, err := time.ParseDuration(c.Batch)
+		if err != nil { return fmt.Errorf("batch: %v", err) }
+		if d <= 0 {
+			return fmt.Errorf("batch %v isn't positive", d)
+		}
+	}
+	if c.Settle != "" {
+		d, err := time.ParseDuration(c.Settle)
+		if err != nil { return fmt.Errorf("settle: %v", err) }
+		if d < 0 {
+			return fmt.Errorf("settle %v is negative", d)
+		}
+	}
+	switch c.KeyFormat {
+	case "", keyRaw, keyBase64, keyArmor:
+	default:
+		return fmt.Errorf("unknown key-format %q", c.KeyFormat)
+	}
+	switch c.KeyProvider {
+	case "", providerFile, providerKeychain, providerPKCS11:
+	default:
+		return fmt.Errorf("unknown key-provider %q", c.KeyProvider)
+	}
+	for _, p := range c.Ignore {
+		if _, err := path.Match(strings.Trim(p, "/"), ""); err != nil {
+			return fmt.Errorf("bad ignore pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// apply sets each flag c sets that wasn't given on the command line
+func (c *Config) apply() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	values := map[string]string{}
+	str := func(name, v string) {
+		if v != "" {
+			values[name] = v
+		}
+	}
+	num := func(name string, v uint64) {
+		if v != 0 {
+			values[name] = strconv.FormatUint(v, 10)
+		}
+	}
+	boolean := func(name string, v bool) {
+		if v {
+			values[name] = "true"
+		}
+	}
+	str("secret-dir", c.SecretDir)
+	str("crypt-dir", c.CryptDir)
+	num("jobs", uint64(c.Jobs))
+	num("max-inflight", uint64(c.MaxInFlight))
+	str("batch", c.Batch)
+	str("settle", c.Settle)
+	if c.Compress != nil {
+		values["compress"] = strconv.FormatBool(*c.Compress)
+	}
+	boolean("cdc", c.CDC)
+	boolean("trust-mtime", c.TrustMtime)
+	boolean("follow-symlinks", c.FollowSymlinks)
+	num("chunk-min", uint64(c.ChunkMin))
+	num("chunk-avg", uint64(c.ChunkAvg))
+	num("chunk-max", uint64(c.ChunkMax))
+	num("kdf-time", uint64(c.KDFTime))
+	num("kdf-memory", uint64(c.KDFMemory))
+	num("kdf-threads", uint64(c.KDFThreads))
+	str("escrow", c.Escrow)
+	str("recipients", c.Recipients)
+	str("recipients-dir", c.RecipientsDir)
+	str("key-format", c.KeyFormat)
+	str("key-provider", c.KeyProvider)
+	boolean("log-json", c.LogJSON)
+	boolean("progress", c.Progress)
+	boolean("audit", c.Audit)
+	str("metrics-addr", c.MetricsAddr)
+	boolean("insecure-perms", c.InsecurePerms)
+	for name, v := range values {
+		if set[name] {
+			continue
+		}
+		err := flag.Set(name, v)
+		if err != nil { return fmt.Errorf("config %s: %v", name, err) }
+	}
+	configIgnore = c.Ignore
+	return nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// chunkSize is the most plaintext sealed into a single chunk of crypt/
+const chunkSize = secretary.ChunkSize
+
+// mmapMin is the size from which sumFile maps a file into memory rather than reading
+// it through a buffer, below it mapping costs more than the copy it saves
+const mmapMin = 1 << 20
+
+// sumFile returns the sha256 sum and size of the file at path
+func sumFile(path string) ([32]byte, int64, error) {
+	sum := [32]byte{}
+	f, err := os.Open(path)
+	if err != nil { return sum, 0, err }
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil { return sum, 0, err }
+	if n := fi.Size(); n >= mmapMin && int64(int(n)) == n {
+		b, err := syscall.Mmap(int(f.Fd()), 0, int(n), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err == nil {
+			defer syscall.Munmap(b)
+			sum, err = sumMapped(b)
+			if err != nil { return sum, 0, fmt.Errorf("%s: %v", path, err) }
+			return sum, n, nil
+		}
+		// some filesystems can't map files, those are read instead
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil { return sum, 0, err }
+	copy(sum[:], h.Sum(nil))
+	return sum, n, nil
+}
+
+// sumMapped returns the sha256 sum of b, a file mapped into memory; a file cut short
+// while it's summed faults on the pages no longer there, which fails the sum rather
+// than crashing serv
+func sumMapped(b []byte) (sum [32]byte, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("changed while it was summed")
+		}
+	}()
+	return sha256.Sum256(b), nil
+}
+
+// countWriter counts the bytes written to it, and discards them
+type countWriter struct{
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// deflatedSize returns how many bytes the file at path compresses to
+func deflatedSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil { return 0, err }
+	defer f.Close()
+	c := &countWriter{}
+	zw, err := flate.NewWriter(c, flate.DefaultCompression)
+	if err != nil { return 0, err }
+	_, err = io.Copy(zw, f)
+	if err != nil { return 0, err }
+	err = zw.Close()
+	if err != nil { return 0, err }
+	return c.n, nil
+}
+
+// encryptFile seals secret/<name> into chunks of crypt/ under a random content key
+// of its own, sealed from the server's keys to the recipient derived from the
+// file's sum and passphrase
+//
+// the file is read a chunk at a time so it never has to fit in memory, it's read
+// by the caller for its sum and again here to seal it, and first to measure how
+// well it compresses when compression is enabled; files that don't shrink are
+// sealed as they are; with -cdc each chunk is compressed on its own instead, so an
+// edit doesn't change how the chunks after it compress
+//
+// each chunk is sealed with its index and whether it's the last as additional
+// data, under a synthetic nonce; a chunk the version before has at the same index,
+// matched by its MAC, is kept as it is in crypt/ unless cut short, its content key
+// sealed to the new recipient, and any other is sealed anew under the new content
+// key, which no version before has, so a recipient removed since can't open what
+// changed; a kept chunk is only checked for its size, it's -verify that reads it
+//
+// an encryption that doesn't finish leaves chunks under a content key it never
+// records, the next one seals them anew and gc removes them
+func (s *serv) encryptFile(name string, sum [32]byte) (*FileMeta, error) {
+	kdf := s.kdf
+	recipientPub, recipientPrv, err := secretary.DeriveRecipient(sum, s.passphrase, &kdf)
+	if err != nil { return nil, err }
+	var escrow *EscrowMeta
+	if s.escrow != nil {
+		escrow, err = s.sealEscrow(name, recipientPrv)
+	}
+	var recipients map[string][]byte
+	if err == nil {
+		recipients, err = s.sealRecipients(name, recipientPrv)
+	}
+	secretary.Zero(recipientPrv)
+	if err != nil { return nil, err }
+	shared, err := s.keys.Shared(recipientPub)
+	if err != nil { return nil, err }
+	defer secretary.Zero(shared)
+	contentKey, err := secretary.NewKey()
+	if err != nil { return nil, err }
+	defer secretary.Zero(contentKey)
+	sealedKey, err := secretary.SealAD(nil, contentKey[:], contentKeyAD(name, 0), shared)
+	if err != nil { return nil, err }
+	macKey, err := s.keys.Derive(chunkMACLabel)
+	if err != nil { return nil, err }
+	defer secretary.Wipe(macKey)
+
+	src := secretPath(name)
+	compressed := false
+	if s.compress && s.cdc == nil {
+		fi, err := os.Stat(src)
+		if err != nil { return nil, err }
+		n, err := deflatedSize(src)
+		if err != nil { return nil, err }
+		compressed = n < fi.Size()
+	}
+	prev := s.previousChunks(name, compressed)
+	defer prev.close()
+
+	f, err := os.Open(src)
+	if err != nil { return nil, err }
+	defer f.Close()
+	h := sha256.New()
+	var r io.Reader = io.TeeReader(f, h)
+	if compressed {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			zw, err := flate.NewWriter(pw, flate.DefaultCompression)
+			if err == nil {
+				_, err = io.Copy(zw, r)
+			}
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}(r)
+		r = pr
+	}
+
+	meta := &FileMeta{
+		Sum: sum[:],
+		RecipientPub: recipientPub[:],
+		KeyVersion: s.keys.Version(),
+		KDF: &kdf,
+		Compressed: compressed,
+		Cipher: cipherContent,
+		Escrow: escrow,
+		Recipients: recipients,
+		RecipientNames: s.recipientNames(),
+		ContentKeys: [][]byte{sealedKey},
+		Chunks: []ChunkMeta{},
+	}
+	err = os.MkdirAll(chunkDir(name), 0700)
+	if err != nil { return nil, err }
+	// a chunk is only known to be the last once reading the one after it finds
+	// nothing, so each is read into ahead while the one before waits in buf
+	buf, ahead := make([]byte, chunkSize), make([]byte, chunkSize)
+	next := func(buf []byte) (int, error) {
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return n, err
+	}
+	if s.cdc != nil {
+		buf, ahead = make([]byte, s.cdc.max), make([]byte, s.cdc.max)
+		br := bufio.NewReader(r)
+		next = func(buf []byte) (int, error) { return s.cdc.next(br, buf) }
+	}
+	defer func() { secretary.Wipe(buf); secretary.Wipe(ahead) }()
+	deflated := &bytes.Buffer{}
+	defer func() { secretary.Wipe(deflated.Bytes()) }()
+	// frame holds each chunk as it's sealed, only until it's written
+	frame := &bytes.Buffer{}
+	n, err := next(buf)
+	for err != io.EOF {
+		if err != nil { return nil, err }
+		m, errAhead := next(ahead)
+		last := errAhead == io.EOF
+
+		i := len(meta.Chunks)
+		c := ChunkMeta{MAC: chunkMAC(macKey, i, last, buf[:n])}
+		plain := buf[:n]
+		if s.compress && s.cdc != nil {
+			err = deflateChunk(deflated, plain)
+			if err != nil { return nil, err }
+			if deflated.Len() < n {
+				plain, c.Deflated = deflated.Bytes(), true
+			}
+		}
+		var ok bool
+		c, ok, err = prev.keep(name, c, int64(len(plain)+secretary.FrameOverhead), meta, shared)
+		if err != nil { return nil, err }
+		if ok {
+			atomic.AddInt64(&metrics.chunksKept, 1)
+		} else {
+			frame.Reset()
+			c.Nonce, err = secretary.SealFrameSynthetic(frame, plain, contentAD(name, i, last), contentKey)
+			if err != nil { return nil, err }
+			encrypted := frame.Bytes()
+			chunkSum := sha256.Sum256(encrypted)
+			c.Sum = hex.EncodeToString(chunkSum[:])
+			err = atomicWrite(chunkPath(name, c.Sum), encrypted, 0600)
+			if err != nil { return nil, err }
+			atomic.AddInt64(&metrics.chunksWritten, 1)
+		}
+		meta.Chunks = append(meta.Chunks, c)
+		buf, ahead = ahead, buf
+		n, err = m, errAhead
+	}
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		return nil, fmt.Errorf("%s changed while being encrypted", name)
+	}
+	return meta, writeMeta(name, meta)
+}
+
+// chunkMACLabel names the key of the server's that chunks' MACs are under, apart
+// from any that seals
+const chunkMACLabel = "serv chunk mac"
+
+// chunkMAC is the MAC of chunk i of a file, plain, under key, telling whether the
+// next version has the same chunk in the same place without the chunk itself
+func chunkMAC(key []byte, i int, last bool, plain []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(contentAD("", i, last))
+	mac.Write(plain)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keptChunks are the chunks of the version of a file before that the next version
+// may keep, by their MACs, and the content keys they're sealed under
+type keptChunks struct{
+	chunks map[string]ChunkMeta
+	keys []*[32]byte
+	// moved is the index in the next version's ContentKeys of each of keys once
+	// it's sealed to its recipient
+	moved map[int]int
+}
+
+// previousChunks are the chunks of the version of name before that its next
+// version, compressed as a whole or not, may keep, none unless that version is
+// sealed by these keys of the server's with a content key and also compressed or
+// not; reencrypt keeps none, leaving nothing sealed under what the old passphrase
+// opens
+func (s *serv) previousChunks(name string, compressed bool) *keptChunks {
+	if s.reseal {
+		return nil
+	}
+	meta, err := readMeta(name)
+	if err != nil || meta.KeyVersion != s.keys.Version() || meta.Cipher != cipherContent || meta.Compressed != compressed || len(meta.RecipientPub) != 32 {
+		return nil
+	}
+	pub := &[32]byte{}
+	copy(pub[:], meta.RecipientPub)
+	shared, err := s.keys.Shared(pub)
+	if err != nil { return nil }
+	defer secretary.Zero(shared)
+	keys, err := openContentKeys(name, meta, shared)
+	if err != nil {
+		logf(verbose, "keeping none of the chunks of %s: %v\n", name, err)
+		return nil
+	}
+	kc := &keptChunks{chunks: map[string]ChunkMeta{}, keys: keys, moved: map[int]int{}}
+	for _, c := range meta.Chunks {
+		if c.MAC != "" && c.Key >= 0 && c.Key < len(keys) {
+			kc.chunks[c.MAC] = c
+		}
+	}
+	return kc
+}
+
+// keep returns the chunk of the version before with the MAC of c, sealed the way c
+// is about to be, if there's one of size bytes in crypt/, with its content key
+// sealed under shared into meta
+func (kc *keptChunks) keep(name string, c ChunkMeta, size int64, meta *FileMeta, shared *[32]byte) (ChunkMeta, bool, error) {
+	if kc == nil {
+		return c, false, nil
+	}
+	old, ok := kc.chunks[c.MAC]
+	if !ok || old.Deflated != c.Deflated || !chunkThere(chunkPath(name, old.Sum), size) {
+		return c, false, nil
+	}
+	k, ok := kc.moved[old.Key]
+	if !ok {
+		k = len(meta.ContentKeys)
+		sealed, err := secretary.SealAD(nil, kc.keys[old.Key][:], contentKeyAD(name, k), shared)
+		if err != nil { return c, false, err }
+		meta.ContentKeys = append(meta.ContentKeys, sealed)
+		kc.moved[old.Key] = k
+	}
+	c.Sum, c.Nonce, c.Key = old.Sum, old.Nonce, k
+	return c, true, nil
+}
+
+// close forgets the content keys of kc
+func (kc *keptChunks) close() {
+	if kc != nil {
+		zeroKeys(kc.keys)
+	}
+}
+
+// chunkThere reports whether the chunk at p is there with its size bytes, not cut
+// short; what it holds isn't read
+func chunkThere(p string, size int64) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Size() == size
+}
+
+// contentKeyAD binds content key k of name, sealed to its recipient, to its file
+// and place among the file's content keys
+func contentKeyAD(name string, k int) []byte {
+	ad := append([]byte("content key\x00"), name...)
+	return append(ad, 0, byte(k>>24), byte(k>>16), byte(k>>8), byte(k))
+}
+
+// openContentKeys opens the content keys of name, sealed under shared
+func openContentKeys(name string, meta *FileMeta, shared *[32]byte) ([]*[32]byte, error) {
+	keys := []*[32]byte{}
+	for k, sealed := range meta.ContentKeys {
+		b, err := secretary.OpenAD(nil, sealed, contentKeyAD(name, k), shared)
+		if err == nil && len(b) != 32 {
+			err = fmt.Errorf("bad length %d", len(b))
+		}
+		if err != nil {
+			zeroKeys(keys)
+			return nil, fmt.Errorf("content key %d of %s: %w", k, name, err)
+		}
+		ck := &[32]byte{}
+		copy(ck[:], b)
+		secretary.Wipe(b)
+		keys = append(keys, ck)
+	}
+	return keys, nil
+}
+
+// zeroKeys wipes each of keys
+func zeroKeys(keys []*[32]byte) {
+	for _, k := range keys {
+		secretary.Zero(k)
+	}
+}
+
+// deflateChunk compresses chunk into buf, which it resets first
+func deflateChunk(buf *bytes.Buffer, chunk []byte) error {
+	secretary.Wipe(buf.Bytes())
+	buf.Reset()
+	zw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil { return err }
+	_, err = zw.Write(chunk)
+	if err != nil { return err }
+	return zw.Close()
+}
+
+// chunkAD is the additional data sealed with chunk i of name before cipherContent,
+// binding the chunk to its place in its file so chunks can't be swapped within crypt/
+func chunkAD(name string, i int) []byte {
+	ad := make([]byte, len(name)+1+8)
+	copy(ad, name)
+	binary.BigEndian.PutUint64(ad[len(name)+1:], uint64(i))
+	return ad
+}
+
+// contentAD is the additional data sealed with chunk i of name, binding the chunk
+// to its place in its file and whether it's the last, so chunks can't be swapped
+// within crypt/ nor the last ones dropped
+func contentAD(name string, i int, last bool) []byte {
+	ad := make([]byte, len(name)+1+8+1)
+	copy(ad, name)
+	binary.BigEndian.PutUint64(ad[len(name)+1:], uint64(i))
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// chunkReader reads the opened chunks of a file, in order
+type chunkReader struct{
+	name string
+	cipher string
+	chunks []ChunkMeta
+	shared *[32]byte
+	// keys are the content keys the chunks are sealed under, with cipherContent
+	keys []*[32]byte
+	// index is the index in its file of chunks[0]
+	index int
+
+	// decrypted is the chunk being read, buf is what's left of it to read
+	decrypted []byte
+	buf []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		secretary.Wipe(cr.decrypted)
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		var err error
+		cr.decrypted, err = cr.open(cr.chunks[0])
+		if err == nil && cr.chunks[0].Deflated {
+			cr.decrypted, err = inflateChunk(cr.decrypted)
+		}
+		if err != nil { return 0, err }
+		cr.buf = cr.decrypted
+		cr.chunks = cr.chunks[1:]
+		cr.index++
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// inflateChunk decompresses the chunk b, wiping it
+func inflateChunk(b []byte) ([]byte, error) {
+	defer secretary.Wipe(b)
+	zr := flate.NewReader(bytes.NewReader(b))
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// open reads and decrypts the chunk c
+func (cr *chunkReader) open(c ChunkMeta) ([]byte, error) {
+	encrypted, err := ioutil.ReadFile(chunkPath(cr.name, c.Sum))
+	if err != nil { return nil, err }
+	switch cr.cipher {
+	case cipherContent:
+		if c.Key < 0 || c.Key >= len(cr.keys) {
+			return nil, fmt.Errorf("%s chunk %s is under content key %d of %d", cr.name, c.Sum, c.Key, len(cr.keys))
+		}
+		return cr.openFrame(c, encrypted, contentAD(cr.name, cr.index, len(cr.chunks) == 1), cr.keys[c.Key])
+	case cipherFrame:
+		return cr.openFrame(c, encrypted, chunkAD(cr.name, cr.index), cr.shared)
+	}
+	if len(encrypted) < secretary.Overhead {
+		return nil, fmt.Errorf("bad length of %s chunk %s: %d", cr.name, c.Sum, len(encrypted))
+	}
+
+	// the nonce the chunk was sealed with is stored alongside it, and must be
+	// the one recorded for it
+	if !bytes.Equal(encrypted[:secretary.NonceSize], c.Nonce) {
+		return nil, fmt.Errorf("nonce of %s chunk %s doesn't match its metadata", cr.name, c.Sum)
+	}
+	var decrypted []byte
+	switch cr.cipher {
+	case cipherBox:
+		decrypted, err = secretary.Open(nil, encrypted, cr.shared)
+	case cipherXChaCha:
+		decrypted, err = secretary.OpenAD(nil, encrypted, chunkAD(cr.name, cr.index), cr.shared)
+	default:
+		err = fmt.Errorf("unknown cipher %q", cr.cipher)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decryption of %s chunk %s failed: %w", cr.name, c.Sum, err)
+	}
+	return decrypted, nil
+}
+
+// openFrame opens the chunk c, the single frame encrypted, sealed with ad under k
+func (cr *chunkReader) openFrame(c ChunkMeta, encrypted, ad []byte, k *[32]byte) ([]byte, error) {
+	r := bytes.NewReader(encrypted)
+	decrypted, nonce, err := secretary.OpenFrame(r, ad, k)
+	if err == io.EOF {
+		err = fmt.Errorf("empty chunk")
+	}
+	if err == nil && r.Len() > 0 {
+		err = fmt.Errorf("%d bytes after its frame", r.Len())
+	}
+	if err == nil && !bytes.Equal(nonce, c.Nonce) {
+		err = fmt.Errorf("nonce doesn't match its metadata")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decryption of %s chunk %s failed: %w", cr.name, c.Sum, err)
+	}
+	return decrypted, nil
+}
+
+// decryptFile recovers the plaintext of name from its chunks in crypt/
+func decryptFile(name string) ([]byte, error) {
+	b := &bytes.Buffer{}
+	err := decryptTo(b, name)
+	if err != nil { return nil, err }
+	return b.Bytes(), nil
+}
+
+// manifestChunks gathers the chunks of name in the order the manifest lists them,
+// which must be the chunks its metadata records
+func manifestChunks(name string, meta *FileMeta) ([]ChunkMeta, error) {
+	d, err := loadDigest()
+	if err != nil { return nil, err }
+	m, err := loadManifest(d)
+	if err != nil { return nil, err }
+	sums, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't in %s", name, manifestPath())
+	}
+	if len(sums) != len(meta.Chunks) {
+		return nil, fmt.Errorf("%s lists %d chunks of %s, its metadata %d", manifestPath(), len(sums), name, len(meta.Chunks))
+	}
+	chunks := make([]ChunkMeta, len(sums))
+	for i, sum := range sums {
+		if sum != meta.Chunks[i].Sum {
+			return nil, fmt.Errorf("chunk %d of %s is %s in %s, %s in its metadata", i, name, sum, manifestPath(), meta.Chunks[i].Sum)
+		}
+		chunks[i] = meta.Chunks[i]
+	}
+	return chunks, nil
+}
+
+// recipientOf is the recipient's private key of name, derived from its sum and the
+// passphrase or, given -recovery-key, opened from its escrow copy or, given -identity, opened
+// from the copy sealed to it
+func recipientOf(name string, meta *FileMeta, sum [32]byte, srvPub key) (key, error) {
+	if *identity != "" {
+		prv, err := readKey(*identity, true)
+		if err != nil { return nil, err }
+		defer secretary.Zero(prv)
+		return openRecipient(name, meta, srvPub, prv)
+	}
+	if *recoveryKey != "" {
+		recoveryPrv, err := readKey(*recoveryKey, true)
+		if err != nil { return nil, err }
+		defer secretary.Zero(recoveryPrv)
+		return openEscrow(name, meta, srvPub, recoveryPrv)
+	}
+	passphrase, err := readPassphrase()
+	if err != nil { return nil, err }
+	defer secretary.Wipe(passphrase)
+	_, prv, err := secretary.DeriveRecipient(sum, passphrase, meta.KDF)
+	return prv, err
+}
+
+// decryptTo writes the plaintext of name to w a chunk at a time, using the server's
+// public key of the version that sealed it and the recipient's private key, derived
+// from the sum recorded in secret/, to open its content keys
+//
+// the server's private key is never read, so decrypting with -identity or
+// -recovery-key, away from the server, takes only its public key
+func decryptTo(w io.Writer, name string) error {
+	meta, err := readMeta(name)
+	if err != nil { return err }
+	chunks, err := manifestChunks(name, meta)
+	if err != nil { return err }
+	srvPub, err := readSrvPub(meta.KeyVersion)
+	if err != nil { return err }
+
+	if len(meta.Sum) != 32 {
+		return fmt.Errorf("bad length of %s sum %d", name, len(meta.Sum))
+	}
+	sum := [32]byte{}
+	copy(sum[:], meta.Sum)
+	recipientPrv, err := recipientOf(name, meta, sum, srvPub)
+	if err != nil { return err }
+	defer secretary.Zero(recipientPrv)
+	recipientPub, err := secretary.PublicKey(recipientPrv)
+	if err != nil { return err }
+	if !bytes.Equal(recipientPub[:], meta.RecipientPub) {
+		return fmt.Errorf("recipient of %s doesn't match, wrong passphrase? (%w)", name, ErrAuthFailed)
+	}
+	shared := secretary.Precompute(srvPub, recipientPrv)
+	defer secretary.Zero(shared)
+	keys, err := openContentKeys(name, meta, shared)
+	if err != nil { return err }
+	defer zeroKeys(keys)
+
+	cr := &chunkReader{name: name, cipher: meta.Cipher, chunks: chunks, shared: shared, keys: keys}
+	defer secretary.Wipe(cr.decrypted)
+	var r io.Reader = cr
+	if meta.Compressed {
+		zr := flate.NewReader(cr)
+		defer zr.Close()
+		r = zr
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), r)
+	if err != nil { return err }
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		return fmt.Errorf("decrypted %s doesn't match its sum: %w", name, ErrAuthFailed)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// TestKeepWholeChunks checks that encrypting a file again keeps its chunks in crypt/
+// at their full size, unread, even one corrupted, which is left to -verify, and
+// writes again those cut short
+func TestKeepWholeChunks(t *testing.T) {
+	s := newTestServ(t)
+	payload := noise(4*chunkSize + 3)
+	writeSecret(t, "f", payload)
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	sums := s.manifest["f"]
+	cut, flipped := chunkPath("f", sums[0]), chunkPath("f", sums[1])
+	b, err := ioutil.ReadFile(cut)
+	if err == nil {
+		err = ioutil.WriteFile(cut, b[:len(b)-1], 0600)
+	}
+	if err == nil {
+		b, err = ioutil.ReadFile(flipped)
+	}
+	if err == nil {
+		b[len(b)/2] ^= 1
+		err = ioutil.WriteFile(flipped, b, 0600)
+	}
+	if err != nil { t.Fatal(err) }
+
+	written, kept := atomic.LoadInt64(&metrics.chunksWritten), atomic.LoadInt64(&metrics.chunksKept)
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	written, kept = atomic.LoadInt64(&metrics.chunksWritten)-written, atomic.LoadInt64(&metrics.chunksKept)-kept
+	if written != 1 || kept != int64(len(sums)-1) {
+		t.Errorf("wrote %d chunks and kept %d, want 1 and %d", written, kept, len(sums)-1)
+	}
+	if s.manifest["f"][1] != sums[1] {
+		t.Errorf("the corrupted chunk wasn't kept")
+	}
+	out := &bytes.Buffer{}
+	ok, err := verify(s.digest, s.manifest, out)
+	if err != nil || ok || !bytes.Contains(out.Bytes(), []byte("mismatched "+flipped)) {
+		t.Errorf("crypt/ verifies with a chunk corrupted: %v\n%s", err, out)
+	}
+	_, err = decryptFile("f")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("decrypted with a chunk corrupted: %v, want %v", err, ErrAuthFailed)
+	}
+}
+
+// TestKeepEditedChunks checks that a file edited in place keeps the chunks the edit
+// leaves alone, under the content key they were sealed under, and seals the rest
+// under a new one
+func TestKeepEditedChunks(t *testing.T) {
+	s := newTestServ(t)
+	s.compress = false
+	payload := noise(4 * chunkSize)
+	writeSecret(t, "f", payload)
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	before, err := readMeta("f")
+	if err != nil { t.Fatal(err) }
+
+	payload[2*chunkSize+5] ^= 1
+	writeSecret(t, "f", payload)
+	written := atomic.LoadInt64(&metrics.chunksWritten)
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	if written = atomic.LoadInt64(&metrics.chunksWritten) - written; written != 1 {
+		t.Errorf("wrote %d chunks, want the one edited", written)
+	}
+	meta, err := readMeta("f")
+	if err != nil { t.Fatal(err) }
+	if bytes.Equal(meta.RecipientPub, before.RecipientPub) {
+		t.Errorf("the edited file has the recipient of the file before")
+	}
+	if len(meta.ContentKeys) != 2 {
+		t.Fatalf("%d content keys, want the new one and the one kept", len(meta.ContentKeys))
+	}
+	for i, c := range meta.Chunks {
+		kept := c.Sum == before.Chunks[i].Sum
+		if kept != (i != 2) || kept != (c.Key == 1) {
+			t.Errorf("chunk %d kept %v under content key %d", i, kept, c.Key)
+		}
+	}
+	got, err := decryptFile("f")
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("decrypted %d bytes: %v", len(got), err)
+	}
+
+	// reencrypt keeps nothing sealed under a content key the old passphrase opens
+	s.passphrase = []byte("new " + testPassphrase)
+	os.Setenv(passphraseEnv, string(s.passphrase))
+	written = atomic.LoadInt64(&metrics.chunksWritten)
+	err = s.reencrypt([]byte(testPassphrase))
+	if err != nil { t.Fatal(err) }
+	if written = atomic.LoadInt64(&metrics.chunksWritten) - written; written != 4 {
+		t.Errorf("reencrypt wrote %d chunks, want all 4", written)
+	}
+	meta, err = readMeta("f")
+	if err != nil { t.Fatal(err) }
+	if len(meta.ContentKeys) != 1 {
+		t.Errorf("%d content keys once encrypted again, want 1", len(meta.ContentKeys))
+	}
+}
+
+func TestMultiChunkRoundTrip(t *testing.T) {
+	s := newTestServ(t)
+	s.compress = false
+	for _, n := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		payload := noise(n)
+		writeSecret(t, "f", payload)
+		err := s.encrypt("f")
+		if err != nil { t.Fatal(err) }
+		meta, err := readMeta("f")
+		if err != nil { t.Fatal(err) }
+		if want := (n + chunkSize - 1) / chunkSize; len(meta.Chunks) != want {
+			t.Errorf("%d bytes sealed into %d chunks, want %d", n, len(meta.Chunks), want)
+		}
+		if !sameChunks(s.manifest["f"], meta) {
+			t.Errorf("%d bytes: the manifest doesn't list the chunks of the metadata", n)
+		}
+		got, err := decryptFile("f")
+		if err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		} else if !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: decrypted %d bytes that aren't what was encrypted", n, len(got))
+		}
+	}
+}
+
+// TestChunkOrder checks that chunks listed out of order don't decrypt, even when the
+// metadata and manifest agree on the order
+func TestChunkOrder(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "f", noise(3*chunkSize))
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	meta, err := readMeta("f")
+	if err != nil { t.Fatal(err) }
+	meta.Chunks[0], meta.Chunks[1] = meta.Chunks[1], meta.Chunks[0]
+	sums := s.manifest["f"]
+	sums[0], sums[1] = sums[1], sums[0]
+	err = writeMeta("f", meta)
+	if err == nil {
+		err = saveManifest(s.manifest)
+	}
+	if err != nil { t.Fatal(err) }
+	_, err = decryptFile("f")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("chunks out of order: %v, want %v", err, ErrAuthFailed)
+	}
+
+	// without its last chunk, the chunk before isn't the last it was sealed as
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	meta, err = readMeta("f")
+	if err != nil { t.Fatal(err) }
+	keys, err := testContentKeys("f", meta)
+	if err != nil { t.Fatal(err) }
+	defer zeroKeys(keys)
+	cr := &chunkReader{name: "f", cipher: meta.Cipher, chunks: meta.Chunks[:2], keys: keys}
+	_, err = io.Copy(ioutil.Discard, cr)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("last chunk dropped: %v, want %v", err, ErrAuthFailed)
+	}
+}
+
+// testContentKeys opens the content keys of name, as decryptTo does
+func testContentKeys(name string, meta *FileMeta) ([]*[32]byte, error) {
+	sum := [32]byte{}
+	copy(sum[:], meta.Sum)
+	_, prv, err := secretary.DeriveRecipient(sum, []byte(testPassphrase), meta.KDF)
+	if err != nil { return nil, err }
+	defer secretary.Zero(prv)
+	srvPub, err := readSrvPub(meta.KeyVersion)
+	if err != nil { return nil, err }
+	shared := secretary.Precompute(srvPub, prv)
+	defer secretary.Zero(shared)
+	return openContentKeys(name, meta, shared)
+}
+
+// text is n bytes of config-like lines, which compress well
+func text(n int) []byte {
+	b := &bytes.Buffer{}
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(b, "key%d = value of setting %d\n", i, i*7)
+	}
+	return b.Bytes()[:n]
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	s := newTestServ(t)
+	for _, c := range []struct{
+		name string
+		payload []byte
+		compressed bool
+	}{
+		{"text", text(3*chunkSize + 5), true},
+		{"noise", noise(3*chunkSize + 5), false},
+	} {
+		for _, cdc := range []*cdc{nil, {min: 4 << 10, avg: 16 << 10, max: 64 << 10}} {
+			s.cdc = cdc
+			writeSecret(t, c.name, c.payload)
+			err := s.encrypt(c.name)
+			if err != nil { t.Fatal(err) }
+			meta, err := readMeta(c.name)
+			if err != nil { t.Fatal(err) }
+			deflated := 0
+			for _, ch := range meta.Chunks {
+				if ch.Deflated {
+					deflated++
+				}
+			}
+			var size int64
+			for _, sum := range s.manifest[c.name] {
+				size += chunkFileSize(c.name, sum)
+			}
+			// without -cdc the whole file is compressed, with it each chunk on its own
+			want := 0
+			if c.compressed && cdc != nil {
+				want = len(meta.Chunks)
+			}
+			if meta.Compressed != (c.compressed && cdc == nil) || deflated != want {
+				t.Errorf("%s with -cdc %v: compressed %v and %d of %d chunks deflated", c.name, cdc != nil, meta.Compressed, deflated, len(meta.Chunks))
+			}
+			if c.compressed && size*2 > int64(len(c.payload)) {
+				t.Errorf("%s: %d bytes sealed into %d", c.name, len(c.payload), size)
+			}
+			got, err := decryptFile(c.name)
+			if err != nil || !bytes.Equal(got, c.payload) {
+				t.Errorf("%s with -cdc %v: decrypted %d bytes: %v", c.name, cdc != nil, len(got), err)
+			}
+		}
+	}
+}
+
+// BenchmarkSumFile sums a large file as sumFile does, mapping it, and by reading it
+// through a buffer as it does files under mmapMin
+func BenchmarkSumFile(b *testing.B) {
+	newTestServ(b)
+	writeSecret(b, "f", noise(16<<20))
+	b.Run("mapped", func(b *testing.B) {
+		b.SetBytes(16 << 20)
+		for i := 0; i < b.N; i++ {
+			_, _, err := sumFile(secretPath("f"))
+			if err != nil { b.Fatal(err) }
+		}
+	})
+	b.Run("read", func(b *testing.B) {
+		b.SetBytes(16 << 20)
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(secretPath("f"))
+			if err != nil { b.Fatal(err) }
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil { b.Fatal(err) }
+		}
+	})
+}
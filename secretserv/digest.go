@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// digestEntry records the checksum of a file in secret/ when it was last encrypted
+//
+// the checksums of the chunks it was sealed into are kept in the manifest, Chunks
+// is only read from digests from before the manifest
+//
+// Size and MTime, in nanoseconds since the epoch, are what the file's were before it
+// was summed, for -trust-mtime; a file can change without them changing, so they're
+// only trusted when asked to
+type digestEntry struct{
+	Sum string `json:"sum"`
+	Encrypted time.Time `json:"encrypted"`
+	Size int64 `json:"size,omitempty"`
+	MTime int64 `json:"mtime,omitempty"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// unchanged reports whether the file of e still has the size and mtime of fi
+func (e digestEntry) unchanged(fi os.FileInfo) bool {
+	return e.Sum != "" && e.MTime != 0 && e.Size == fi.Size() && e.MTime == fi.ModTime().UnixNano()
+}
+
+// Digest maps each encrypted file of secret/ to its entry, it is kept up-to-date
+// in crypt/digest.json as a JSON object of the entries
+//
+// its entries are only got and set through its methods, which any number of
+// goroutines may call at once; what ranges over them ranges over a Snapshot
+type Digest struct{
+	mu sync.Mutex
+	entries map[string]digestEntry
+}
+
+func newDigest() *Digest {
+	return &Digest{entries: map[string]digestEntry{}}
+}
+
+// Get is the entry of name, false if there's none
+func (d *Digest) Get(name string) (digestEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[name]
+	return e, ok
+}
+
+// Set sets the entry of name to e
+func (d *Digest) Set(name string, e digestEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[name] = e
+}
+
+// Delete removes the entry of name
+func (d *Digest) Delete(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, name)
+}
+
+// Len is the number of entries
+func (d *Digest) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.entries)
+}
+
+// Snapshot is a copy of the entries as they are, which later changes leave alone
+func (d *Digest) Snapshot() map[string]digestEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := make(map[string]digestEntry, len(d.entries))
+	for name, e := range d.entries {
+		m[name] = e
+	}
+	return m
+}
+
+func (d *Digest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Snapshot())
+}
+
+func (d *Digest) UnmarshalJSON(b []byte) error {
+	m := map[string]digestEntry{}
+	err := json.Unmarshal(b, &m)
+	if err != nil { return err }
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = m
+	return nil
+}
+
+// loadDigest reads crypt/digest.json, which is empty before the first encryption
+func loadDigest() (*Digest, error) {
+	b, err := ioutil.ReadFile(digestPath())
+	if os.IsNotExist(err) {
+		return newDigest(), nil
+	}
+	if err != nil { return nil, err }
+	return parseDigest(b)
+}
+
+func parseDigest(b []byte) (*Digest, error) {
+	d := newDigest()
+	err := json.Unmarshal(b, d)
+	if err != nil { return nil, fmt.Errorf("bad %s: %v", digestPath(), err) }
+	return d, nil
+}
+
+// digestMAC is the HMAC-SHA256 of the contents b of crypt/digest.json, keyed by a
+// key derived from the server's private key, which only serv has
+func digestMAC(b []byte, keys KeyProvider) ([]byte, error) {
+	k, err := keys.Derive("serv digest.json")
+	if err != nil { return nil, err }
+	defer secretary.Wipe(k)
+	mac := hmac.New(sha256.New, k)
+	mac.Write(b)
+	return mac.Sum(nil), nil
+}
+
+// loadTrustedDigest is loadDigest, checking crypt/digest.json against its MAC in
+// crypt/digest.json.sig; a digest that fails is empty, as its sums can't be trusted
+// to skip any file, so every file is encrypted again
+func loadTrustedDigest(keys KeyProvider) (*Digest, error) {
+	b, err := ioutil.ReadFile(digestPath())
+	if os.IsNotExist(err) {
+		return newDigest(), nil
+	}
+	if err != nil { return nil, err }
+	sig, err := ioutil.ReadFile(digestSigPath())
+	if err != nil && !os.IsNotExist(err) { return nil, err }
+	want, _ := hex.DecodeString(strings.TrimSpace(string(sig)))
+	mac, err := digestMAC(b, keys)
+	if err != nil { return nil, err }
+	if !hmac.Equal(want, mac) {
+		fmt.Fprintf(os.Stderr, "warning: not trusting %s, it doesn't match %s; encrypting every file again\n",
+			digestPath(), digestSigPath())
+		return newDigest(), nil
+	}
+	return parseDigest(b)
+}
+
+// saveDigest writes crypt/digest.json, and its MAC to crypt/digest.json.sig
+func saveDigest(d *Digest, keys KeyProvider) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil { return err }
+	mac, err := digestMAC(b, keys)
+	if err != nil { return err }
+	err = atomicWrite(digestPath(), b, 0600)
+	if err != nil { return err }
+	return atomicWrite(digestSigPath(), []byte(hex.EncodeToString(mac)+"\n"), 0600)
+}
+
+// result is the outcome of checking one file of secret/
+type result struct{
+	name string
+	sum [32]byte
+	size int64
+	// mtime is the file's before it was summed
+	mtime time.Time
+	encrypted bool
+	meta *FileMeta
+	took time.Duration
+	err error
+}
+
+// encrypt encrypts name and records its sum in the digest
+func (s *serv) encrypt(name string) error {
+	start := time.Now()
+	r := result{name: name, encrypted: true}
+	if fi, err := s.statSecret(name); err == nil {
+		r.mtime = fi.ModTime()
+	}
+	r.sum, r.size, r.err = sumFile(secretPath(name))
+	if r.err == nil {
+		r.seal(s)
+	}
+	r.took = time.Since(start)
+	return s.record(r)
+}
+
+// finish counts r in the metrics and the progress, logs it and audits it
+func (s *serv) finish(r result) {
+	countResult(r)
+	defer s.progress.done(r)
+	s.logResult(r)
+	s.auditResult(r)
+}
+
+// updateAll encrypts each file named in batch unless the digest records it
+// unchanged since it was last encrypted, recording them all at once; names no
+// longer of regular files are skipped
+func (s *serv) updateAll(batch map[string]bool) error {
+	s.reloadRecipients()
+	names := []string{}
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rs := []result{}
+	for _, name := range names {
+		fi, err := s.statSecret(name)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		prev, _ := s.digest.Get(name)
+		rs = append(rs, s.check(name, prev))
+	}
+	return s.recordAll(rs)
+}
+
+// check encrypts name unless its sum is still that of prev, its entry in the
+// digest; with -trust-mtime, a file whose size and mtime are still those of prev
+// isn't even summed
+//
+// the digest is only read through prev, so many workers can check files at once
+func (s *serv) check(name string, prev digestEntry) (r result) {
+	start := time.Now()
+	defer func() { r.took = time.Since(start) }()
+	r.name = name
+	fi, err := s.statSecret(name)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.mtime = fi.ModTime()
+	if s.trustMtime && prev.unchanged(fi) {
+		if _, err := os.Stat(metaPath(name)); err == nil {
+			b, _ := hex.DecodeString(prev.Sum)
+			copy(r.sum[:], b)
+			r.size = fi.Size()
+			return r
+		}
+	}
+	r.sum, r.size, r.err = sumFile(secretPath(name))
+	if r.err != nil {
+		return r
+	}
+	if prev.Sum == hex.EncodeToString(r.sum[:]) {
+		if _, err := os.Stat(metaPath(name)); err == nil {
+			return r
+		}
+	}
+	r.encrypted = true
+	r.seal(s)
+	return r
+}
+
+// seal encrypts the file of r, whose sum is known
+func (r *result) seal(s *serv) {
+	r.meta, r.err = s.encryptFile(r.name, r.sum)
+}
+
+// record saves the sum of a newly encrypted file in the digest and its chunks in
+// the manifest, removing the chunks it no longer has, and logs r
+func (s *serv) record(r result) error {
+	return s.recordAll([]result{r})
+}
+
+// recordAll is record of many results, saving the digest and manifest once for
+// them all; it returns the first error of any
+//
+// under -trust-mtime, unchanged files whose size or mtime the digest doesn't have
+// yet are recorded too, to be trusted from then on
+func (s *serv) recordAll(rs []result) error {
+	defer func() { atomic.StoreInt64(&metrics.trackedFiles, int64(s.digest.Len())) }()
+	var first error
+	encrypted := []result{}
+	touched := false
+	old := map[string][]string{}
+	for _, r := range rs {
+		if r.err != nil {
+			s.finish(r)
+			if first == nil {
+				first = fmt.Errorf("encrypting %s: %v", r.name, r.err)
+			}
+			continue
+		}
+		if !r.encrypted {
+			if e, ok := s.digest.Get(r.name); ok && s.trustMtime && e.Sum == hex.EncodeToString(r.sum[:]) && !r.mtime.IsZero() &&
+				(e.Size != r.size || e.MTime != r.mtime.UnixNano()) {
+				e.Size, e.MTime = r.size, r.mtime.UnixNano()
+				s.digest.Set(r.name, e)
+				touched = true
+			}
+			s.finish(r)
+			continue
+		}
+		old[r.name] = s.manifest[r.name]
+		chunks := []string{}
+		for _, c := range r.meta.Chunks {
+			chunks = append(chunks, c.Sum)
+		}
+		s.manifest[r.name] = chunks
+		e := digestEntry{Sum: hex.EncodeToString(r.sum[:]), Encrypted: time.Now(), Size: r.size}
+		if !r.mtime.IsZero() {
+			e.MTime = r.mtime.UnixNano()
+		}
+		s.digest.Set(r.name, e)
+		encrypted = append(encrypted, r)
+	}
+	if len(encrypted) == 0 {
+		if touched {
+			err := saveDigest(s.digest, s.keys)
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+
+	err := saveManifest(s.manifest)
+	if err == nil {
+		err = saveDigest(s.digest, s.keys)
+	}
+	if err == nil {
+		err = savePrevious(old)
+	}
+	refs := s.manifest.refs()
+	for _, r := range encrypted {
+		if err == nil {
+			err = prune(r.name, old[r.name], refs)
+		}
+		r.err = err
+		s.finish(r)
+	}
+	if first == nil {
+		first = err
+	}
+	return first
+}
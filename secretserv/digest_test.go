@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDigestConcurrent sets entries from many goroutines at once, as the workers of
+// a scan do, while others snapshot and marshal the digest; run it with -race
+func TestDigestConcurrent(t *testing.T) {
+	d := newDigest()
+	const workers, files = 8, 200
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < files; i++ {
+				name := fmt.Sprintf("w%d/f%d", w, i)
+				d.Set(name, digestEntry{Sum: name, Size: int64(i)})
+				if _, ok := d.Get(name); !ok {
+					t.Errorf("%s not there once set", name)
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	read := sync.WaitGroup{}
+	read.Add(1)
+	go func() {
+		defer read.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := json.Marshal(d)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for name, e := range d.Snapshot() {
+				if e.Sum != name {
+					t.Errorf("entry of %s has the sum %s", name, e.Sum)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	read.Wait()
+
+	if d.Len() != workers*files {
+		t.Fatalf("%d entries, want %d", d.Len(), workers*files)
+	}
+	snap := d.Snapshot()
+	b, err := json.Marshal(d)
+	if err != nil { t.Fatal(err) }
+	back, err := parseDigest(b)
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(back.Snapshot(), snap) {
+		t.Errorf("digest read back isn't the one marshalled")
+	}
+
+	// a snapshot is a copy, changing the digest after leaves it alone
+	d.Set("w0/f0", digestEntry{Sum: "changed", Encrypted: time.Now()})
+	d.Delete("w0/f1")
+	if snap["w0/f0"].Sum != "w0/f0" || len(snap) != workers*files {
+		t.Errorf("snapshot changed along with the digest")
+	}
+}
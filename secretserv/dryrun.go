@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dryRun reports to w which files under secret/ are new, changed or unchanged
+// since they were last encrypted, without writing anything
+func (s *serv) dryRun(w io.Writer) error {
+	var added, changed, unchanged int
+	err := s.walk(secretDir, func(name string) error {
+		sum, _, err := sumFile(secretPath(name))
+		if err != nil { return err }
+		e, ok := s.digest.Get(name)
+		switch {
+		case !ok:
+			added++
+			fmt.Fprintf(w, "new       %s\n", name)
+		case e.Sum != hex.EncodeToString(sum[:]):
+			changed++
+			fmt.Fprintf(w, "changed   %s\n", name)
+		default:
+			if _, err := os.Stat(metaPath(name)); err != nil {
+				changed++
+				fmt.Fprintf(w, "changed   %s (no metadata)\n", name)
+				return nil
+			}
+			unchanged++
+			fmt.Fprintf(w, "unchanged %s\n", name)
+		}
+		return nil
+	})
+	if err != nil { return err }
+	fmt.Fprintf(w, "%d new, %d changed, %d unchanged\n", added, changed, unchanged)
+	return nil
+}
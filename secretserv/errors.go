@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// the kinds of failure callers tell apart with errors.Is, each wrapped with what
+// failed; not authentic is secretary.ErrAuthFailed
+var (
+	ErrKeyNotFound = errors.New("no key")
+	ErrBadKeyLength = errors.New("bad length")
+	ErrAuthFailed = secretary.ErrAuthFailed
+	ErrLocked = errors.New("another serv is already running")
+	// ErrNoSrvKeys is the error of a store never set up, without the server's keys
+	// or even secret/
+	ErrNoSrvKeys = errors.New("no server keys found")
+)
+
+// exitCode is the exit status serv fails with for err, so scripts can tell an
+// inauthentic file, a held lock or a store not set up from any other failure
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		return 3
+	case errors.Is(err, ErrLocked):
+		return 4
+	case errors.Is(err, ErrNoSrvKeys):
+		return 5
+	}
+	return 1
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	s := newTestServ(t)
+	dir := t.TempDir()
+
+	_, err := readKey(filepath.Join(dir, "missing"), false)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("missing key file: %v, want %v", err, ErrKeyNotFound)
+	}
+
+	short := filepath.Join(dir, "short")
+	err = ioutil.WriteFile(short, []byte(base64.StdEncoding.EncodeToString(make([]byte, 31))), 0600)
+	if err != nil { t.Fatal(err) }
+	_, err = readKey(short, false)
+	if !errors.Is(err, ErrBadKeyLength) {
+		t.Errorf("key of 31 bytes: %v, want %v", err, ErrBadKeyLength)
+	}
+
+	writeSecret(t, "f", noise(2*chunkSize))
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	p := chunkPath("f", s.manifest["f"][1])
+	b, err := ioutil.ReadFile(p)
+	if err == nil {
+		b[len(b)-1] ^= 1
+		err = ioutil.WriteFile(p, b, 0600)
+	}
+	if err != nil { t.Fatal(err) }
+	_, err = decryptFile("f")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("chunk flipped: %v, want %v", err, ErrAuthFailed)
+	}
+
+	err = acquireLock()
+	if err != nil { t.Fatal(err) }
+	defer releaseLock()
+	held := lockFile
+	err = acquireLock()
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock: %v, want %v", err, ErrLocked)
+	}
+	if lockFile != held {
+		t.Errorf("second lock replaced the lock held")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct{
+		err error
+		code int
+	}{
+		{fmt.Errorf("decrypted f doesn't match its sum: %w", ErrAuthFailed), 3},
+		{fmt.Errorf("%w as pid 1", ErrLocked), 4},
+		{fmt.Errorf("serv: %w", ErrNoSrvKeys), 5},
+		{fmt.Errorf("%w secret/serv_prv", ErrKeyNotFound), 1},
+		{errors.New("anything else"), 1},
+	} {
+		if code := exitCode(c.err); code != c.code {
+			t.Errorf("exit code of %q is %d, want %d", c.err, code, c.code)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// EscrowMeta is the escrow copy of a file's recipient key, sealed from the server's
+// keys to a recovery key so whoever holds the recovery private key can decrypt the
+// file without the passphrase
+//
+// sealing the recipient's private key rather than every chunk again recovers all
+// of the file's chunks at once, and costs a few bytes of metadata instead of a
+// second copy of the file in crypt/
+type EscrowMeta struct{
+	RecoveryPub []byte `json:"recovery_pub"`
+	SealedKey []byte `json:"sealed_key"`
+}
+
+// escrowAD binds the sealed recipient key to the file it's the key of
+func escrowAD(name string) []byte {
+	return append([]byte("escrow\x00"), name...)
+}
+
+// generateRecoveryKey generates a recovery keypair, the private key at path and the
+// public key, the one given to -escrow, at path.pub
+func generateRecoveryKey(path string) error {
+	pub, prv, err := secretary.GenerateKey()
+	if err != nil { return err }
+	defer secretary.Zero(prv)
+	err = writeKey(path, prv, true, 0400)
+	if err != nil { return err }
+	err = writeKey(path+".pub", pub, false, 0444)
+	if err != nil { return err }
+	fmt.Printf("generated %s and %s.pub: %x\n", path, path, pub[:])
+	return nil
+}
+
+// sealEscrow seals recipientPrv, the recipient key of name, to s.escrow
+func (s *serv) sealEscrow(name string, recipientPrv key) (*EscrowMeta, error) {
+	shared, err := s.keys.Shared(s.escrow)
+	if err != nil { return nil, err }
+	defer secretary.Zero(shared)
+	sealed, err := secretary.SealAD(nil, recipientPrv[:], escrowAD(name), shared)
+	if err != nil { return nil, err }
+	return &EscrowMeta{RecoveryPub: append([]byte{}, s.escrow[:]...), SealedKey: sealed}, nil
+}
+
+// openEscrow opens the escrow copy of the recipient key of name with the recovery
+// private key, sealed from the server's public key srvPub
+func openEscrow(name string, meta *FileMeta, srvPub, recoveryPrv key) (key, error) {
+	if meta.Escrow == nil {
+		return nil, fmt.Errorf("%s has no escrow copy of its key", name)
+	}
+	shared := secretary.Precompute(srvPub, recoveryPrv)
+	defer secretary.Zero(shared)
+	b, err := secretary.OpenAD(nil, meta.Escrow.SealedKey, escrowAD(name), shared)
+	if err != nil {
+		return nil, fmt.Errorf("escrow of %s isn't sealed to this recovery key: %w", name, err)
+	}
+	defer secretary.Wipe(b)
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w of escrowed key of %s %d", ErrBadKeyLength, name, len(b))
+	}
+	prv := &[32]byte{}
+	copy(prv[:], b)
+	return prv, nil
+}
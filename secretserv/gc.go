@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// isChunkName reports whether base is named like a chunk, by the hex sha256 of
+// its contents
+func isChunkName(base string) bool {
+	b, err := hex.DecodeString(base)
+	return err == nil && len(b) == 32
+}
+
+// gc removes each chunk of crypt/ the manifest doesn't reference, left behind by
+// files encrypted again since, reporting each to w; with dryRun it only reports
+// them
+//
+// only files named like chunks are ever removed, never serv's own files
+func gc(m Manifest, dryRun bool, w io.Writer) error {
+	refs := m.refs()
+	var n int
+	err := filepath.WalkDir(cryptDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(cryptDir, p)
+		if err != nil { return err }
+		if isCryptFile(filepath.ToSlash(rel)) || !isChunkName(de.Name()) || refs[p] > 0 {
+			return nil
+		}
+		n++
+		if dryRun {
+			fmt.Fprintf(w, "would remove %s\n", p)
+			return nil
+		}
+		fmt.Fprintf(w, "remove %s\n", p)
+		return os.Remove(p)
+	})
+	if err != nil { return err }
+	if dryRun {
+		fmt.Fprintf(w, "%d orphaned chunks would be removed\n", n)
+	} else {
+		fmt.Fprintf(w, "%d orphaned chunks removed\n", n)
+	}
+	return nil
+}
+
+// deletedFiles lists the files of the digest gone from secret/, in order
+//
+// a file is only gone if looking it up finds nothing there; any other error, or
+// secret/ itself missing, as when it isn't mounted, fails rather than counting
+// files as gone that may only be out of reach
+func deletedFiles(d *Digest) ([]string, error) {
+	_, err := os.Stat(secretDir)
+	if err != nil { return nil, err }
+	entries := d.Snapshot()
+	gone := []string{}
+	for name := range entries {
+		_, err := os.Lstat(secretPath(name))
+		if os.IsNotExist(err) {
+			gone = append(gone, name)
+			continue
+		}
+		if err != nil { return nil, err }
+	}
+	sort.Strings(gone)
+	if len(gone) > 0 && len(gone) == len(entries) && !*force {
+		return nil, fmt.Errorf("every file of %s is gone from %s, -force to prune them all", digestPath(), secretDir)
+	}
+	return gone, nil
+}
+
+// pruneDeleted drops the files gone from secret/ from the digest and manifest,
+// and removes their metadata and chunks, reporting each to w; with dryRun it only
+// reports them
+//
+// once pruned a file can't be decrypted, crypt/ no longer has it
+func (s *serv) pruneDeleted(dryRun bool, w io.Writer) error {
+	gone, err := deletedFiles(s.digest)
+	if err != nil { return err }
+	if dryRun {
+		for _, name := range gone {
+			fmt.Fprintf(w, "would prune %s\n", name)
+		}
+		fmt.Fprintf(w, "%d deleted files would be pruned\n", len(gone))
+		return nil
+	}
+	if len(gone) == 0 {
+		fmt.Fprintf(w, "0 deleted files pruned\n")
+		return nil
+	}
+
+	old := map[string][]string{}
+	for _, name := range gone {
+		old[name] = s.manifest[name]
+		delete(s.manifest, name)
+		s.digest.Delete(name)
+	}
+	err = saveManifest(s.manifest)
+	if err != nil { return err }
+	err = saveDigest(s.digest, s.keys)
+	if err != nil { return err }
+	gonePrev := map[string][]string{}
+	for _, name := range gone {
+		gonePrev[name] = nil
+	}
+	err = savePrevious(gonePrev)
+	if err != nil { return err }
+	refs := s.manifest.refs()
+	for _, name := range gone {
+		err = prune(name, old[name], refs)
+		if err != nil { return err }
+		err = os.Remove(metaPath(name))
+		if err != nil && !os.IsNotExist(err) { return err }
+		s.auditOrWarn(auditEntry{Time: time.Now(), File: name, Action: "pruned"})
+		fmt.Fprintf(w, "prune %s\n", name)
+	}
+	fmt.Fprintf(w, "%d deleted files pruned\n", len(gone))
+	return nil
+}
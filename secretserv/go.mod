@@ -1,6 +1,12 @@
 module github.com/rugrah/ru/serv
 
+go 1.16
+
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/rugrah/ru v0.0.0-20210324212102-516f9f4cc0bb
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
+
+replace github.com/rugrah/ru => ../
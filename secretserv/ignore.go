@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreFile in secret/ lists glob patterns of files not to encrypt, one per line
+// with # starting a comment
+//
+// as in .gitignore, a pattern without a slash matches a file or directory of that
+// name at any depth, one with a slash matches a path relative to secret/, and one
+// ending in a slash only matches directories; everything under an ignored directory
+// is ignored
+const ignoreFile = ".serveignore"
+
+type ignoreRules []string
+
+// loadIgnore reads the patterns of secret/.serveignore, there are none if it's
+// missing, after those of -config
+func loadIgnore() (ignoreRules, error) {
+	rules := append(ignoreRules{}, configIgnore...)
+	f, err := os.Open(srvPath(ignoreFile))
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(strings.Trim(line, "/"), ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad pattern %q", ignoreFile, n, line)
+		}
+		rules = append(rules, line)
+	}
+	return rules, sc.Err()
+}
+
+// match reports whether name, relative to secret/, is ignored
+func (rules ignoreRules) match(name string) bool {
+	parts := strings.Split(name, "/")
+	for _, rule := range rules {
+		dirOnly := strings.HasSuffix(rule, "/")
+		rule = strings.Trim(rule, "/")
+		anchored := strings.Contains(rule, "/")
+		for i := range parts {
+			if dirOnly && i == len(parts)-1 {
+				break
+			}
+			var ok bool
+			if anchored {
+				ok, _ = path.Match(rule, strings.Join(parts[:i+1], "/"))
+			} else {
+				ok, _ = path.Match(rule, parts[i])
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// the encodings of key files: the raw 32 bytes, their base64 on a line, or the
+// base64 armored as PEM so it survives being pasted into a ticket or a password
+// manager with its name attached
+const (
+	keyRaw = "raw"
+	keyBase64 = "base64"
+	keyArmor = "armor"
+)
+
+// pemType is the type of the PEM block of a private or public key
+func pemType(private bool) string {
+	if private {
+		return "SERV PRIVATE KEY"
+	}
+	return "SERV PUBLIC KEY"
+}
+
+// encodeKey encodes k as a key file of format
+func encodeKey(k key, private bool, format string) ([]byte, error) {
+	switch format {
+	case keyRaw:
+		return append([]byte{}, k[:]...), nil
+	case keyBase64:
+		return []byte(base64.StdEncoding.EncodeToString(k[:]) + "\n"), nil
+	case keyArmor:
+		return pem.EncodeToMemory(&pem.Block{Type: pemType(private), Bytes: k[:]}), nil
+	}
+	return nil, fmt.Errorf("unknown key format %q, want %s, %s or %s", format, keyRaw, keyBase64, keyArmor)
+}
+
+// decodeKey decodes the key file b of any format, telling them apart by trying
+// each: armored, then base64, then the raw 32 bytes, which are never 32 bytes of
+// base64
+func decodeKey(b []byte, private bool) ([]byte, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != pemType(private) {
+			return nil, fmt.Errorf("%s where a %s belongs", block.Type, pemType(private))
+		}
+		return block.Bytes, nil
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil { return nil, fmt.Errorf("neither raw, base64 nor armored") }
+	return k, nil
+}
+
+// parseKey is the 32 byte key of the key file b in any format, named what in errors
+func parseKey(b []byte, private bool, what string) (key, error) {
+	d, err := decodeKey(b, private)
+	if err != nil { return nil, fmt.Errorf("bad key %s: %v", what, err) }
+	defer secretary.Wipe(d)
+	if len(d) != 32 {
+		return nil, fmt.Errorf("%w of key %s: %d", ErrBadKeyLength, what, len(d))
+	}
+	k := &[32]byte{}
+	copy(k[:], d)
+	return k, nil
+}
+
+// parseKeyPair is the keypair of the key files pubBytes and prvBytes, however they
+// were come by, named pubName and prvName in errors; its version is left 0
+func parseKeyPair(pubBytes, prvBytes []byte, pubName, prvName string) (*keyPair, error) {
+	pub, err := parseKey(pubBytes, false, pubName)
+	if err != nil { return nil, err }
+	prv, err := parseKey(prvBytes, true, prvName)
+	if err != nil { return nil, err }
+	return &keyPair{pub: pub, prv: prv}, nil
+}
+
+// readKeyFile reads the key file at path, private keys must only be readable by
+// their owner; the caller wipes what's read
+func readKeyFile(path string, private bool) ([]byte, error) {
+	if private && !*insecurePerms {
+		err := checkPerms(path)
+		if err != nil { return nil, err }
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w %s", ErrKeyNotFound, path)
+	}
+	return b, err
+}
+
+// readKey reads a 32 byte key in any format from the file at path, private keys
+// must only be readable by their owner
+func readKey(path string, private bool) (key, error) {
+	b, err := readKeyFile(path, private)
+	if err != nil { return nil, err }
+	defer secretary.Wipe(b)
+	return parseKey(b, private, path)
+}
+
+// writeKey writes k to the file at path in the format of -key-format
+func writeKey(path string, k key, private bool, perm os.FileMode) error {
+	b, err := encodeKey(k, private, *keyFormat)
+	if err != nil { return err }
+	defer secretary.Wipe(b)
+	return atomicWrite(path, b, perm)
+}
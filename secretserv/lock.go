@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockInfo is recorded in crypt/.lock while serv is running, for people to read;
+// what keeps a second serv out is the flock held on it
+type lockInfo struct{
+	PID int `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// lockFile is crypt/.lock while this process holds its flock
+var lockFile *os.File
+
+// readLock reads what f, crypt/.lock, records; it's empty once its serv stopped
+func readLock(f *os.File) (*lockInfo, error) {
+	b, err := ioutil.ReadAll(f)
+	if err != nil || len(b) == 0 { return nil, err }
+	l := &lockInfo{}
+	err = json.Unmarshal(b, l)
+	if err != nil { return nil, fmt.Errorf("bad %s: %v", lockPath(), err) }
+	return l, nil
+}
+
+// acquireLock takes an exclusive flock on crypt/.lock, held until releaseLock or
+// this process exits, and records this process in it
+//
+// the kernel releases the flock of a serv that died, so a lock is never stale, only
+// what it records of the serv before; that's why -force doesn't override it, a
+// held lock is always of a serv still running
+func acquireLock() error {
+	f, err := os.OpenFile(lockPath(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil { return err }
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		old, _ := readLock(f)
+		f.Close()
+		if old == nil {
+			return fmt.Errorf("%w, see %s", ErrLocked, lockPath())
+		}
+		return fmt.Errorf("%w as pid %d since %s, see %s", ErrLocked,
+			old.PID, old.Started.Format(time.RFC3339), lockPath())
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("locking %s: %v", lockPath(), err)
+	}
+	if old, err := readLock(f); err != nil || old != nil {
+		fmt.Fprintf(os.Stderr, "warning: the serv before didn't stop cleanly, see %s\n", lockPath())
+	}
+
+	b, err := json.Marshal(&lockInfo{PID: os.Getpid(), Started: time.Now()})
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(b, 0)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lockFile = f
+	return nil
+}
+
+// releaseLock empties crypt/.lock and releases its flock
+//
+// the file is left in place, removing it would let a serv waiting on the old one
+// and a serv creating a new one both lock a crypt/.lock at once
+func releaseLock() error {
+	err := lockFile.Truncate(0)
+	cerr := lockFile.Close()
+	lockFile = nil
+	if err != nil { return err }
+	return cerr
+}
+
+// lockHolder reports what crypt/.lock records of the serv holding its flock, nil
+// if no serv holds it
+func lockHolder() (*lockInfo, error) {
+	f, err := os.Open(lockPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil { return nil, err }
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		return nil, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return nil, fmt.Errorf("locking %s: %v", lockPath(), err)
+	}
+	l, err := readLock(f)
+	if err != nil { return nil, err }
+	if l == nil {
+		// it's between locking the file and recording itself
+		l = &lockInfo{}
+	}
+	return l, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// the verbosity of what serv tells of on stderr: nothing but warnings and errors
+// under -quiet, what it does by default, and details of how under -v
+const (
+	quiet = iota
+	normal
+	verbose
+)
+
+var verbosity = normal
+
+// logf tells of something on stderr if the verbosity is at least level
+func logf(level int, format string, args ...interface{}) {
+	if verbosity >= level {
+		clearProgress()
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// logEvent is logged as a line of JSON for each file handled, under -log-json
+type logEvent struct{
+	Time time.Time `json:"time"`
+	Filename string `json:"filename"`
+	Checksum string `json:"checksum,omitempty"`
+	Bytes int64 `json:"bytes"`
+	Chunks int `json:"chunks"`
+	Action string `json:"action"`
+	DurationMS float64 `json:"duration_ms"`
+	Error string `json:"error,omitempty"`
+}
+
+// logResult logs the handling of a file, as JSON to stdout under -log-json and
+// otherwise readably to stderr, where unchanged files are only mentioned under -v
+func (s *serv) logResult(r result) {
+	action := "unchanged"
+	switch {
+	case r.err != nil:
+		action = "error"
+	case r.encrypted:
+		action = "encrypted"
+	}
+
+	if !s.logJSON {
+		switch action {
+		case "encrypted":
+			logf(normal, "encrypted %s\n", r.name)
+		case "unchanged":
+			logf(verbose, "unchanged %s\n", r.name)
+		}
+		return
+	}
+
+	ev := logEvent{
+		Time: time.Now().UTC(),
+		Filename: r.name,
+		Bytes: r.size,
+		Action: action,
+		DurationMS: float64(r.took) / float64(time.Millisecond),
+	}
+	if r.meta != nil {
+		ev.Chunks = len(r.meta.Chunks)
+	}
+	if r.sum != ([32]byte{}) {
+		ev.Checksum = hex.EncodeToString(r.sum[:])
+	}
+	if r.err != nil {
+		ev.Error = r.err.Error()
+	}
+	b, err := json.Marshal(&ev)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logging %s: %v\n", r.name, err)
+		return
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
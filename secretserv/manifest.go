@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Manifest maps each encrypted file of secret/ to the checksums of the chunks of
+// crypt/ it was sealed into, in order, it is kept up-to-date in crypt/manifest.json
+// along with the digest
+//
+// a chunk an edit leaves alone belongs to the new version of its file as well as
+// the old, so it's only removed from crypt/ once the manifest no longer references
+// it; chunks of different files are never the same, each sealed under a key of its
+// file's name, so references are counted by the chunk's path
+type Manifest map[string][]string
+
+// loadManifest reads crypt/manifest.json, which is empty before the first encryption
+//
+// digests from before the manifest listed the chunks of each file themselves, the
+// manifest of such a digest is made from those lists
+func loadManifest(d *Digest) (Manifest, error) {
+	m := Manifest{}
+	b, err := ioutil.ReadFile(manifestPath())
+	if os.IsNotExist(err) {
+		for name, e := range d.Snapshot() {
+			if e.Chunks != nil {
+				m[name] = e.Chunks
+				e.Chunks = nil
+				d.Set(name, e)
+			}
+		}
+		return m, nil
+	}
+	if err != nil { return nil, err }
+	err = json.Unmarshal(b, &m)
+	if err != nil { return nil, fmt.Errorf("bad %s: %v", manifestPath(), err) }
+	return m, nil
+}
+
+// saveManifest writes crypt/manifest.json
+func saveManifest(m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil { return err }
+	return atomicWrite(manifestPath(), b, 0600)
+}
+
+// loadPrevious reads crypt/manifest.prev.json, the chunks each file had before it
+// was last encrypted; files encrypted only once aren't in it
+func loadPrevious() (Manifest, error) {
+	m := Manifest{}
+	b, err := ioutil.ReadFile(previousPath())
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil { return nil, err }
+	err = json.Unmarshal(b, &m)
+	if err != nil { return nil, fmt.Errorf("bad %s: %v", previousPath(), err) }
+	return m, nil
+}
+
+// savePrevious records in crypt/manifest.prev.json the chunks of old each file had
+// before it was encrypted again, dropping the files old has none of
+func savePrevious(old map[string][]string) error {
+	prev, err := loadPrevious()
+	if err != nil { return err }
+	for name, chunks := range old {
+		if chunks == nil {
+			delete(prev, name)
+			continue
+		}
+		prev[name] = chunks
+	}
+	b, err := json.MarshalIndent(prev, "", "  ")
+	if err != nil { return err }
+	return atomicWrite(previousPath(), b, 0600)
+}
+
+// refs counts the files referencing each chunk, by the chunk's path
+func (m Manifest) refs() map[string]int {
+	refs := map[string]int{}
+	for name, sums := range m {
+		for _, sum := range sums {
+			refs[chunkPath(name, sum)]++
+		}
+	}
+	return refs
+}
+
+// prune removes the chunks that were name's before it was encrypted again, unless
+// refs, the manifest's refs, counts them still referenced
+func prune(name string, old []string, refs map[string]int) error {
+	for _, sum := range old {
+		p := chunkPath(name, sum)
+		if refs[p] > 0 {
+			continue
+		}
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) { return err }
+	}
+	return nil
+}
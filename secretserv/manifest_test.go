@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestPruneKeepsShared checks that encrypting an edited file again removes only the
+// chunks the edit replaced, keeping those it shares with the version before
+func TestPruneKeepsShared(t *testing.T) {
+	s := newTestServ(t)
+	s.cdc = &cdc{min: 1 << 10, avg: 4 << 10, max: 16 << 10}
+	orig := noise(128 << 10)
+	writeSecret(t, "f", orig)
+	err := s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	before := append([]string{}, s.manifest["f"]...)
+
+	writeSecret(t, "f", append([]byte("edit"), orig...))
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+	now := map[string]bool{}
+	for _, sum := range s.manifest["f"] {
+		now[sum] = true
+		if _, err := os.Stat(chunkPath("f", sum)); err != nil {
+			t.Errorf("chunk %s of the new version: %v", sum, err)
+		}
+	}
+	var shared int
+	for _, sum := range before {
+		_, err := os.Stat(chunkPath("f", sum))
+		switch {
+		case now[sum]:
+			shared++
+		case err == nil:
+			t.Errorf("chunk %s only of the old version is still in crypt/", sum)
+		case !os.IsNotExist(err):
+			t.Error(err)
+		}
+	}
+	if shared == 0 {
+		t.Errorf("no chunks shared by %d before and %d after an edit", len(before), len(now))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// metaVersion is the version of FileMeta written, bumped whenever its fields change
+// so that metadata of earlier versions can be migrated when it's read
+const metaVersion = 5
+
+// the ciphers chunks are sealed with: nacl/box before version 2, since then
+// XChaCha20-Poly1305 with each chunk's name and index as additional data, first
+// prefixed by its nonce and then as a secretary frame, and since version 5 as a
+// frame under a content key of the file's own
+const (
+	cipherBox = "nacl-box"
+	cipherXChaCha = "xchacha20-poly1305"
+	cipherFrame = "xchacha20-poly1305-frame"
+	// cipherContent is frames under one of the file's ContentKeys, with the name,
+	// the chunk's index and whether it's the last as additional data
+	cipherContent = "xchacha20-poly1305-content"
+)
+
+// ChunkMeta records one sealed chunk, stored in crypt/ under its checksum
+type ChunkMeta struct{
+	Sum string `json:"sum"`
+	Nonce []byte `json:"nonce"`
+	// Deflated is whether the chunk was compressed on its own before it was sealed
+	Deflated bool `json:"deflated,omitempty"`
+	// Key is the index in ContentKeys of the key the chunk is sealed under
+	Key int `json:"key,omitempty"`
+	// MAC is the chunk's plaintext and place, under a key of the server's, which
+	// the next version of the file matches its chunks against to keep them
+	MAC string `json:"mac,omitempty"`
+}
+
+// FileMeta is the per-file metadata kept in secret/ as <name>.meta.json, next to
+// the plaintext, it's all decryption needs besides the server's public key and the
+// shared passphrase
+//
+// the recipient's private key isn't stored, it is derived again from the sum
+// and the shared passphrase
+type FileMeta struct{
+	Version int `json:"version"`
+	Sum []byte `json:"sum"`
+	RecipientPub []byte `json:"recipient_pub"`
+	KeyVersion int `json:"key_version"`
+	KDF *secretary.KDFParams `json:"kdf"`
+	Compressed bool `json:"compressed"`
+	Cipher string `json:"cipher"`
+	Escrow *EscrowMeta `json:"escrow,omitempty"`
+	// Recipients is the recipient's private key sealed to each of -recipients,
+	// by their fingerprints
+	Recipients map[string][]byte `json:"recipients,omitempty"`
+	// RecipientNames names those of Recipients from -recipients-dir, only for
+	// people to read
+	RecipientNames map[string]string `json:"recipient_names,omitempty"`
+	// ContentKeys are the keys the chunks are sealed under, each sealed to the
+	// recipient: the key of this version first, then those of chunks kept from
+	// versions before
+	ContentKeys [][]byte `json:"content_keys,omitempty"`
+	Chunks []ChunkMeta `json:"chunks"`
+}
+
+// migrate brings metadata of an earlier version up to metaVersion
+//
+// version 0 is metadata from before FileMeta had a version, any of its fields may
+// be missing: a missing key version is the unversioned server keys, a missing KDF
+// a passphrase that was hashed rather than stretched, and missing compression an
+// uncompressed file, which is what each field's zero value already means
+//
+// version 1 has no cipher, its chunks were all sealed with nacl/box, version 2 no
+// escrow and version 3 no recipients, which is what a missing escrow or missing
+// recipients mean; version 4 has no content keys, its chunks were sealed under
+// the key shared with the recipient, which its cipher already says
+func (m *FileMeta) migrate() error {
+	switch m.Version {
+	case 0:
+		if len(m.Sum) == 0 {
+			return fmt.Errorf("metadata predates chunking, encrypt the file again")
+		}
+		if m.Chunks == nil {
+			m.Chunks = []ChunkMeta{}
+		}
+		m.Version = 1
+		fallthrough
+	case 1:
+		m.Cipher = cipherBox
+		m.Version = 2
+		fallthrough
+	case 2:
+		m.Version = 3
+		fallthrough
+	case 3:
+		m.Version = 4
+		fallthrough
+	case 4:
+		m.Version = 5
+	case metaVersion:
+	default:
+		return fmt.Errorf("metadata version %d is newer than %d", m.Version, metaVersion)
+	}
+	return nil
+}
+
+// readMeta reads the metadata recorded for name when it was encrypted
+func readMeta(name string) (*FileMeta, error) {
+	b, err := ioutil.ReadFile(metaPath(name))
+	if err != nil { return nil, err }
+	meta := &FileMeta{}
+	err = json.Unmarshal(b, meta)
+	if err == nil {
+		err = meta.migrate()
+	}
+	if err != nil { return nil, fmt.Errorf("bad metadata for %s: %v", name, err) }
+	return meta, nil
+}
+
+// writeMeta records the metadata needed to decrypt name
+func writeMeta(name string, meta *FileMeta) error {
+	meta.Version = metaVersion
+	b, err := json.Marshal(meta)
+	if err != nil { return err }
+	return atomicWrite(metaPath(name), b, 0600)
+}
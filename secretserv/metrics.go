@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics counts what serv has done since it started, read by the -metrics-addr
+// endpoint while the files are being encrypted, so only through sync/atomic
+var metrics struct{
+	filesEncrypted int64
+	bytesEncrypted int64
+	errors int64
+	trackedFiles int64
+	chunksWritten int64
+	chunksKept int64
+}
+
+// countResult adds the handling of r to the metrics
+func countResult(r result) {
+	switch {
+	case r.err != nil:
+		atomic.AddInt64(&metrics.errors, 1)
+	case r.encrypted:
+		atomic.AddInt64(&metrics.filesEncrypted, 1)
+		atomic.AddInt64(&metrics.bytesEncrypted, r.size)
+	}
+}
+
+// serveMetrics writes the metrics in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct{
+		name, kind, help string
+		v *int64
+	}{
+		{"serv_files_encrypted_total", "counter", "Files of secret/ encrypted.", &metrics.filesEncrypted},
+		{"serv_bytes_encrypted_total", "counter", "Bytes of secret/ encrypted, before compression.", &metrics.bytesEncrypted},
+		{"serv_encryption_errors_total", "counter", "Files of secret/ that failed to encrypt.", &metrics.errors},
+		{"serv_chunks_written_total", "counter", "Chunks written to crypt/.", &metrics.chunksWritten},
+		{"serv_chunks_kept_total", "counter", "Chunks sealed that crypt/ already had, and weren't written again.", &metrics.chunksKept},
+		{"serv_tracked_files", "gauge", "Files of secret/ recorded in crypt/digest.json.", &metrics.trackedFiles},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, atomic.LoadInt64(m.v))
+	}
+}
+
+// listenMetrics serves the metrics at /metrics of addr until the returned server
+// is closed; an addr without a host, such as :9464, is only served on localhost
+func listenMetrics(addr string) (*http.Server, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil { return nil, fmt.Errorf("bad -metrics-addr %q: %v", addr, err) }
+	if host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil { return nil, err }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	logf(normal, "serving metrics at http://%s/metrics\n", l.Addr())
+	return srv, nil
+}
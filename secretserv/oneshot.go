@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rugrah/ru/secretary"
+	"golang.org/x/term"
+)
+
+// sealedMagic begins a file sealed by serv encrypt or seal, followed by the public key of
+// the server that sealed it and the frames of its stream
+const sealedMagic = "ru-serv1"
+
+// oneShot runs serv encrypt, decrypt, seal or open, sealing a single file to a
+// recipient outside secret/ and crypt/, with no digest or lock; seal and open are
+// encrypt and decrypt from stdin to stdout
+func oneShot(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	in, out := "-", "-"
+	if cmd == "encrypt" || cmd == "decrypt" {
+		fs.StringVar(&in, "in", in, "read `path`, - for stdin")
+		fs.StringVar(&out, "out", out, "write `path`, - for stdout")
+	}
+	switch cmd {
+	case "encrypt", "seal":
+		to := fs.String("to", "", "public key `file` of the recipient, the server's own if not given")
+		fs.Parse(args)
+		if out == "-" && term.IsTerminal(int(os.Stdout.Fd())) {
+			return fmt.Errorf("not writing what's sealed to a terminal, redirect stdout")
+		}
+		return sealFile(in, out, *to)
+	case "decrypt", "open":
+		prvKey := fs.String("key", "", "private key `file` of the recipient, the server's own if not given")
+		from := fs.String("from", "", "public key `file` the sender's must be")
+		fs.Parse(args)
+		if in == "-" && term.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("not reading what's sealed from a terminal, redirect stdin")
+		}
+		return openFile(in, out, *prvKey, *from)
+	}
+	return fmt.Errorf("unknown command %q, want keygen, encrypt, decrypt, seal or open", cmd)
+}
+
+// currentSrvKeys opens the server's current keys
+func currentSrvKeys() (KeyProvider, error) {
+	version, err := currentKeyVersion()
+	if err != nil { return nil, err }
+	return openKeyProvider(version)
+}
+
+// withFiles calls fn with in and out opened, - being stdin and stdout; out is
+// written atomically, so a failed fn leaves nothing behind
+func withFiles(in, out string, fn func(r io.Reader, w io.Writer) error) error {
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil { return err }
+		defer f.Close()
+		r = f
+	}
+	if out == "-" {
+		return fn(r, os.Stdout)
+	}
+	return atomicWriteFrom(out, 0600, func(w io.Writer) error { return fn(r, w) })
+}
+
+// sealFile seals in to the recipient public key in the file to, or the server's own
+// if to is "", from the server's current keys
+func sealFile(in, out, to string) error {
+	srvKeys, err := currentSrvKeys()
+	if err != nil { return err }
+	defer srvKeys.Close()
+	recipientPub := srvKeys.PublicKey()
+	if to != "" {
+		recipientPub, err = readKey(to, false)
+		if err != nil { return err }
+	}
+
+	return withFiles(in, out, func(r io.Reader, w io.Writer) error {
+		_, err := io.WriteString(w, sealedMagic)
+		if err != nil { return err }
+		_, err = w.Write(srvKeys.PublicKey()[:])
+		if err != nil { return err }
+		shared, err := srvKeys.Shared(recipientPub)
+		if err != nil { return err }
+		defer secretary.Zero(shared)
+		sw := secretary.NewSealWriterPrecomputed(w, shared)
+		_, err = io.Copy(sw, r)
+		if err != nil { return err }
+		return sw.Close()
+	})
+}
+
+// openFile opens in with the recipient private key in the file prvKey, or the
+// server's current keys if prvKey is "", from the server it names, which must be
+// the public key in the file from if given
+func openFile(in, out, prvKey, from string) error {
+	var recipient KeyProvider
+	if prvKey == "" {
+		srvKeys, err := currentSrvKeys()
+		if err != nil { return err }
+		recipient = srvKeys
+	} else {
+		prv, err := readKey(prvKey, true)
+		if err != nil { return err }
+		pub, err := secretary.PublicKey(prv)
+		if err != nil {
+			secretary.Zero(prv)
+			return err
+		}
+		recipient = &keyPair{pub: pub, prv: prv}
+	}
+	defer recipient.Close()
+	var want key
+	var err error
+	if from != "" {
+		want, err = readKey(from, false)
+		if err != nil { return err }
+	}
+
+	name := in
+	if in == "-" {
+		name = "stdin"
+	}
+	return withFiles(in, out, func(r io.Reader, w io.Writer) error {
+		header := make([]byte, len(sealedMagic)+32)
+		_, err := io.ReadFull(r, header)
+		if err != nil || string(header[:len(sealedMagic)]) != sealedMagic {
+			return fmt.Errorf("%s wasn't sealed by serv encrypt or seal", name)
+		}
+		srvPub := &[32]byte{}
+		copy(srvPub[:], header[len(sealedMagic):])
+		if want != nil && !bytes.Equal(srvPub[:], want[:]) {
+			return fmt.Errorf("%s was sealed by %s, not %s", name, fingerprint(srvPub), fingerprint(want))
+		}
+		logf(normal, "sealed by %s\n", fingerprint(srvPub))
+		shared, err := recipient.Shared(srvPub)
+		if err != nil { return err }
+		defer secretary.Zero(shared)
+		_, err = io.Copy(w, secretary.NewOpenReaderPrecomputed(r, shared))
+		return err
+	})
+}
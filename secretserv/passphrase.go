@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// passphraseEnv names the environment variable holding the shared passphrase, and
+// oldPassphraseEnv the one it's replacing under -reencrypt
+const (
+	passphraseEnv = "RU_PASSPHRASE"
+	oldPassphraseEnv = "RU_OLD_PASSPHRASE"
+)
+
+// readPassphrase reads the passphrase shared by all files from $RU_PASSPHRASE, or
+// else prompts for it without echo when attached to a terminal; it's never taken
+// from the command line, where it would leak into shell history and process lists
+func readPassphrase() ([]byte, error) {
+	return readPassphraseFrom(passphraseEnv, "passphrase")
+}
+
+// readPassphraseFrom is readPassphrase of the environment variable env, prompting
+// with what
+func readPassphraseFrom(env, what string) ([]byte, error) {
+	if p, ok := os.LookupEnv(env); ok {
+		if p == "" {
+			return nil, fmt.Errorf("empty $%s", env)
+		}
+		return []byte(p), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no %s: set $%s or run serv from a terminal", what, env)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", what)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil { return nil, err }
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty %s", what)
+	}
+	return b, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+)
+
+// secretDir and cryptDir are where the secrets and what they're encrypted into are
+// kept, set by -secret-dir and -crypt-dir; every path serv uses is built here
+var (
+	secretDir = "secret"
+	cryptDir = "crypt"
+)
+
+// secretPath is the path of name, the slash separated path of a file relative to
+// secret/
+func secretPath(name string) string {
+	return filepath.Join(secretDir, filepath.FromSlash(name))
+}
+
+func metaPath(name string) string {
+	return secretPath(name) + ".meta.json"
+}
+
+// srvPath is the path of one of the server's own files at the top of secret/
+func srvPath(file string) string {
+	return filepath.Join(secretDir, file)
+}
+
+// chunkDir is the directory of crypt/ holding the chunks of name, mirroring the
+// directory name is in under secret/
+func chunkDir(name string) string {
+	return filepath.Join(cryptDir, filepath.FromSlash(path.Dir(name)))
+}
+
+func chunkPath(name, sum string) string {
+	return filepath.Join(chunkDir(name), sum)
+}
+
+func digestPath() string {
+	return filepath.Join(cryptDir, "digest.json")
+}
+
+func auditPath() string {
+	return filepath.Join(cryptDir, "audit.log")
+}
+
+func lockPath() string {
+	return filepath.Join(cryptDir, ".lock")
+}
+
+func digestSigPath() string {
+	return digestPath() + ".sig"
+}
+
+func manifestPath() string {
+	return filepath.Join(cryptDir, "manifest.json")
+}
+
+// previousPath is the path of the manifest of the chunks each file had before it
+// was last encrypted
+func previousPath() string {
+	return filepath.Join(cryptDir, "manifest.prev.json")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// how often -progress tells of a scan: redrawn on its line of a terminal, logged
+// on a line of its own otherwise
+const (
+	progressRedraw = 100 * time.Millisecond
+	progressLog = 5 * time.Second
+)
+
+// progress counts the files of a scan done against those found so far, which
+// only stops growing once the walk of secret/ is over
+//
+// on a terminal it's a line of stderr redrawn in place, which logf clears before
+// anything else is written there; under -log-json it's a line of JSON on stdout
+// between those of the files, so the two never share a line
+type progress struct{
+	mu sync.Mutex
+	json bool
+	tty bool
+	files, total int
+	bytes, totalBytes int64
+	walked bool
+	last time.Time
+}
+
+// shownProgress is the progress whose line is on the terminal, for logf to clear
+var shownProgress struct{
+	sync.Mutex
+	p *progress
+}
+
+func newProgress(logJSON bool) *progress {
+	return &progress{json: logJSON, tty: !logJSON && term.IsTerminal(int(os.Stderr.Fd())), last: time.Now()}
+}
+
+// found counts a file of size to do
+func (p *progress) found(size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total++
+	p.totalBytes += size
+}
+
+// walkedAll marks every file found
+func (p *progress) walkedAll() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.walked = true
+}
+
+// done counts the file of r done, telling of the progress if it's been long enough
+func (p *progress) done(r result) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files++
+	p.bytes += r.size
+	every := progressLog
+	if p.tty {
+		every = progressRedraw
+	}
+	if time.Since(p.last) >= every {
+		p.show()
+	}
+}
+
+// end tells of the progress a last time, leaving the line of the terminal
+func (p *progress) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.show()
+	if p.tty {
+		shownProgress.Lock()
+		fmt.Fprintln(os.Stderr)
+		shownProgress.p = nil
+		shownProgress.Unlock()
+	}
+}
+
+func (p *progress) show() {
+	p.last = time.Now()
+	if p.json {
+		b, _ := json.Marshal(struct{
+			Time time.Time `json:"time"`
+			Action string `json:"action"`
+			Files int `json:"files"`
+			TotalFiles int `json:"total_files"`
+			Bytes int64 `json:"bytes"`
+			TotalBytes int64 `json:"total_bytes"`
+			Walked bool `json:"walked"`
+		}{time.Now().UTC(), "progress", p.files, p.total, p.bytes, p.totalBytes, p.walked})
+		os.Stdout.Write(append(b, '\n'))
+		return
+	}
+	more := "+"
+	if p.walked {
+		more = ""
+	}
+	line := fmt.Sprintf("scanned %d/%d%s files, %s/%s%s", p.files, p.total, more, sizeOf(p.bytes), sizeOf(p.totalBytes), more)
+	if !p.tty {
+		logf(normal, "%s\n", line)
+		return
+	}
+	shownProgress.Lock()
+	defer shownProgress.Unlock()
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s", line)
+	shownProgress.p = p
+}
+
+// clearProgress clears the line of progress off the terminal, for something else
+// to be written there; the next redraw puts it back
+func clearProgress() {
+	shownProgress.Lock()
+	defer shownProgress.Unlock()
+	if shownProgress.p != nil {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		shownProgress.p = nil
+	}
+}
+
+// sizeOf is n bytes readably, in the largest binary unit of at least one
+func sizeOf(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", f, units[i])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// KeyProvider holds the server's keys of a version, serv asks it for what it needs
+// of the private key rather than reading it itself, so the key may be kept by an OS
+// keychain or an HSM instead of serv_prv.asc in secret/
+type KeyProvider interface{
+	// PublicKey is the server's public key
+	PublicKey() key
+	// Version is the version of the server's keys
+	Version() int
+	// Shared is the key shared by the private key and peer, as secretary.Precompute
+	Shared(peer key) (*[32]byte, error)
+	// Derive is the HMAC-SHA256 of label keyed by the private key, a key of its own
+	// for whatever label names
+	Derive(label string) ([]byte, error)
+	// Close forgets the keys
+	Close()
+}
+
+const (
+	providerFile = "file"
+	providerKeychain = "keychain"
+	providerPKCS11 = "pkcs11"
+)
+
+// openKeyProvider opens the server's keys of version with the provider of -key-provider;
+// without even their public key, the store was never set up, which is ErrNoSrvKeys
+func openKeyProvider(version int) (KeyProvider, error) {
+	var kp KeyProvider
+	var err error
+	switch *keyProvider {
+	case providerFile:
+		kp, err = readSrvKeys(version)
+	case providerKeychain:
+		kp, err = readKeychainKeys(version)
+	case providerPKCS11:
+		return nil, errPKCS11
+	default:
+		return nil, fmt.Errorf("unknown -key-provider %q, want %s, %s or %s", *keyProvider, providerFile, providerKeychain, providerPKCS11)
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		if _, serr := os.Stat(srvPath(keyFile("pub", version))); os.IsNotExist(serr) {
+			return nil, fmt.Errorf("%w in %s, run 'serv keygen' first", ErrNoSrvKeys, secretDir)
+		}
+	}
+	if err != nil { return nil, err }
+	return kp, nil
+}
+
+// readSrvPub reads only the server's public key of version from disk, all opening
+// what the server sealed takes; without it the store was never set up, which is
+// ErrNoSrvKeys
+func readSrvPub(version int) (key, error) {
+	pubFile := keyFile("pub", version)
+	pub, err := readKey(srvPath(pubFile), false)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w in %s, run 'serv keygen' first", ErrNoSrvKeys, secretDir)
+	}
+	if err != nil { return nil, err }
+	logf(verbose, "read %s: %x\n", pubFile, pub[:])
+	logf(normal, "fingerprint %s\n", fingerprint(pub))
+	return pub, nil
+}
+
+// the keyPair of readSrvKeys is the file provider, the default, holding both keys in
+// memory as read from secret/
+
+func (kp *keyPair) PublicKey() key { return kp.pub }
+
+func (kp *keyPair) Version() int { return kp.version }
+
+func (kp *keyPair) Shared(peer key) (*[32]byte, error) {
+	return secretary.Precompute(peer, kp.prv), nil
+}
+
+func (kp *keyPair) Derive(label string) ([]byte, error) {
+	kdf := hmac.New(sha256.New, kp.prv[:])
+	kdf.Write([]byte(label))
+	return kdf.Sum(nil), nil
+}
+
+// keychainService is the service of the server's private keys in the macOS keychain,
+// each kept as the password of the account named after its file
+const keychainService = "serv"
+
+// readKeychainKeys reads the server's public key of version from secret/ and its
+// private key from the macOS keychain, where it's the password of keyFile("prv",
+// version) under keychainService in any format a key file may be, so it's never in
+// secret/; add it with
+//
+//	security add-generic-password -s serv -a serv_prv.asc -w "$(base64 < serv_prv.asc)"
+func readKeychainKeys(version int) (*keyPair, error) {
+	pubFile, prvFile := keyFile("pub", version), keyFile("prv", version)
+	pub, err := readKey(srvPath(pubFile), false)
+	if err != nil { return nil, err }
+	logf(normal, "fingerprint %s\n", fingerprint(pub))
+
+	b, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", prvFile, "-w").Output()
+	if err != nil { return nil, fmt.Errorf("%s from the keychain: %v", prvFile, err) }
+	defer secretary.Wipe(b)
+	prv, err := parseKey(b, true, prvFile+" in the keychain")
+	if err != nil { return nil, err }
+	logf(verbose, "read %s from the keychain\n", prvFile)
+	return &keyPair{pub: pub, prv: prv, version: version}, nil
+}
+
+// errPKCS11 is all the pkcs11 provider has for now: an HSM would compute Shared and
+// Derive itself, never handing out the private key
+var errPKCS11 = errors.New("the pkcs11 key provider isn't supported yet")
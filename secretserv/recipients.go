@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// recipientAD binds a sealed recipient key to the file it's the key of
+func recipientAD(name string) []byte {
+	return append([]byte("recipient\x00"), name...)
+}
+
+// recipient is one of the public keys each file's recipient key is sealed to, with
+// the name of its file in -recipients-dir, if it's from there
+type recipient struct{
+	pub key
+	name string
+}
+
+// readRecipients reads the public keys of the file at path, one in base64 per line
+// with # starting a comment, as -key-format base64 writes them
+func readRecipients(path string) ([]recipient, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+	keys := []recipient{}
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: not a base64 public key", path, n)
+		}
+		k := &[32]byte{}
+		copy(k[:], b)
+		if fp := fingerprint(k); !seen[fp] {
+			seen[fp] = true
+			keys = append(keys, recipient{pub: k})
+		}
+	}
+	return keys, sc.Err()
+}
+
+// readRecipientsDir reads the public key of every *.pub file of dir, one person's
+// each, named after its file; a file that isn't a public key is skipped with a
+// warning, so one bad file doesn't lock everyone else out
+func readRecipientsDir(dir string) ([]recipient, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil { return nil, err }
+	keys := []recipient{}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".pub" {
+			continue
+		}
+		pub, err := readKey(filepath.Join(dir, fi.Name()), false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping recipient %v\n", err)
+			continue
+		}
+		keys = append(keys, recipient{pub: pub, name: strings.TrimSuffix(fi.Name(), ".pub")})
+	}
+	return keys, nil
+}
+
+// loadRecipients reads the recipients of -recipients and -recipients-dir, each key
+// only once; a key in both keeps the name of its file in -recipients-dir
+func loadRecipients() ([]recipient, error) {
+	rs := []recipient{}
+	if *recipientsDir != "" {
+		dir, err := readRecipientsDir(*recipientsDir)
+		if err != nil { return nil, err }
+		rs = append(rs, dir...)
+	}
+	if *recipientsFile != "" {
+		file, err := readRecipients(*recipientsFile)
+		if err != nil { return nil, err }
+		rs = append(rs, file...)
+	}
+	seen := map[string]bool{}
+	keys := []recipient{}
+	for _, r := range rs {
+		if fp := fingerprint(r.pub); !seen[fp] {
+			seen[fp] = true
+			keys = append(keys, r)
+		}
+	}
+	return keys, nil
+}
+
+// reloadRecipients reads the recipients again before a pass over secret/, so people
+// added to or removed from -recipients-dir are in or out of what it encrypts next;
+// if they can't be read, the recipients already read are kept
+func (s *serv) reloadRecipients() {
+	if *recipientsDir == "" {
+		return
+	}
+	rs, err := loadRecipients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: keeping the %d recipients read before: %v\n", len(s.recipients), err)
+		return
+	}
+	if len(rs) != len(s.recipients) {
+		logf(normal, "%d recipients\n", len(rs))
+	}
+	s.recipients = rs
+}
+
+// recipientNames maps the fingerprints of the recipients from -recipients-dir to
+// their names, for people reading the metadata
+func (s *serv) recipientNames() map[string]string {
+	names := map[string]string{}
+	for _, r := range s.recipients {
+		if r.name != "" {
+			names[fingerprint(r.pub)] = r.name
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+// sealRecipients seals recipientPrv, the recipient key of name, to each of
+// s.recipients, by their fingerprints
+//
+// whoever holds the private key of any of them can open the recipient key and so
+// all of name's chunks; adding or removing one only seals the recipient key again
+func (s *serv) sealRecipients(name string, recipientPrv key) (map[string][]byte, error) {
+	if len(s.recipients) == 0 {
+		return nil, nil
+	}
+	sealed := map[string][]byte{}
+	for _, r := range s.recipients {
+		shared, err := s.keys.Shared(r.pub)
+		if err != nil { return nil, err }
+		b, err := secretary.SealAD(nil, recipientPrv[:], recipientAD(name), shared)
+		secretary.Zero(shared)
+		if err != nil { return nil, err }
+		sealed[fingerprint(r.pub)] = b
+	}
+	return sealed, nil
+}
+
+// openRecipient opens the recipient key of name sealed to the public key of prv,
+// from the server's public key srvPub
+func openRecipient(name string, meta *FileMeta, srvPub, prv key) (key, error) {
+	pub, err := secretary.PublicKey(prv)
+	if err != nil { return nil, err }
+	sealed, ok := meta.Recipients[fingerprint(pub)]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't encrypted to %s", name, fingerprint(pub))
+	}
+	shared := secretary.Precompute(srvPub, prv)
+	defer secretary.Zero(shared)
+	b, err := secretary.OpenAD(nil, sealed, recipientAD(name), shared)
+	if err != nil {
+		return nil, fmt.Errorf("key of %s sealed to %s: %w", name, fingerprint(pub), err)
+	}
+	defer secretary.Wipe(b)
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w of sealed key of %s %d", ErrBadKeyLength, name, len(b))
+	}
+	recipientPrv := &[32]byte{}
+	copy(recipientPrv[:], b)
+	return recipientPrv, nil
+}
+
+// rewrap seals the recipient key of every file of the digest to s.recipients
+// afresh, leaving their chunks as they are
+func (s *serv) rewrap() error {
+	names := []string{}
+	for name := range s.digest.Snapshot() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		meta, err := readMeta(name)
+		if err != nil { return err }
+		if len(meta.Sum) != 32 {
+			return fmt.Errorf("bad length of %s sum %d", name, len(meta.Sum))
+		}
+		sum := [32]byte{}
+		copy(sum[:], meta.Sum)
+		srvKeys, err := openKeyProvider(meta.KeyVersion)
+		if err != nil { return err }
+		_, recipientPrv, err := secretary.DeriveRecipient(sum, s.passphrase, meta.KDF)
+		if err == nil {
+			var pub key
+			pub, err = secretary.PublicKey(recipientPrv)
+			if err == nil && !bytes.Equal(pub[:], meta.RecipientPub) {
+				err = fmt.Errorf("recipient of %s doesn't match, wrong passphrase? (%w)", name, ErrAuthFailed)
+			}
+		}
+		if err == nil {
+			rs := &serv{keys: srvKeys, recipients: s.recipients}
+			meta.Recipients, err = rs.sealRecipients(name, recipientPrv)
+			meta.RecipientNames = rs.recipientNames()
+		}
+		secretary.Zero(recipientPrv)
+		srvKeys.Close()
+		if err != nil { return err }
+		err = writeMeta(name, meta)
+		if err != nil { return err }
+		s.auditOrWarn(auditEntry{Time: time.Now(), File: name, Action: "rewrapped", Checksum: hex.EncodeToString(meta.Sum)})
+		logf(normal, "rewrapped %s to %d recipients\n", name, len(meta.Recipients))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// TestDecryptWithoutSrvPrv checks that a file decrypts with -identity, -recovery-key
+// or the passphrase once the server's private key is gone, each needing only the
+// server's public key
+func TestDecryptWithoutSrvPrv(t *testing.T) {
+	s := newTestServ(t)
+	idPub, idPrv, err := secretary.GenerateKey()
+	if err != nil { t.Fatal(err) }
+	recoveryPub, recoveryPrv, err := secretary.GenerateKey()
+	if err != nil { t.Fatal(err) }
+	s.recipients = []recipient{{pub: idPub}}
+	s.escrow = recoveryPub
+	payload := []byte("sealed to a recipient and a recovery key too")
+	writeSecret(t, "f", payload)
+	err = s.encrypt("f")
+	if err != nil { t.Fatal(err) }
+
+	err = os.Remove(srvPath(keyFile("prv", 0)))
+	if err != nil { t.Fatal(err) }
+	dir := t.TempDir()
+	idPath, recoveryPath := filepath.Join(dir, "id"), filepath.Join(dir, "recovery")
+	err = writeKey(idPath, idPrv, true, 0400)
+	if err == nil {
+		err = writeKey(recoveryPath, recoveryPrv, true, 0400)
+	}
+	if err != nil { t.Fatal(err) }
+	defer func(i, r string) { *identity, *recoveryKey = i, r }(*identity, *recoveryKey)
+
+	for _, c := range []struct{
+		name, identity, recoveryKey string
+	}{
+		{"identity", idPath, ""},
+		{"recovery key", "", recoveryPath},
+		{"passphrase", "", ""},
+	} {
+		*identity, *recoveryKey = c.identity, c.recoveryKey
+		got, err := decryptFile("f")
+		if err != nil {
+			t.Errorf("with the %s: %v", c.name, err)
+		} else if !bytes.Equal(got, payload) {
+			t.Errorf("with the %s: decrypted %q", c.name, got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// sealedUnder reports whether meta's recipient is the one passphrase derives
+func sealedUnder(meta *FileMeta, passphrase []byte) (bool, error) {
+	if len(meta.Sum) != 32 {
+		return false, fmt.Errorf("bad length of sum %d", len(meta.Sum))
+	}
+	sum := [32]byte{}
+	copy(sum[:], meta.Sum)
+	pub, prv, err := secretary.DeriveRecipient(sum, passphrase, meta.KDF)
+	if err != nil { return false, err }
+	secretary.Zero(prv)
+	return bytes.Equal(pub[:], meta.RecipientPub), nil
+}
+
+// sameChunks reports whether the manifest lists the chunks of meta
+func sameChunks(listed []string, meta *FileMeta) bool {
+	if len(listed) != len(meta.Chunks) {
+		return false
+	}
+	for i, c := range meta.Chunks {
+		if listed[i] != c.Sum {
+			return false
+		}
+	}
+	return true
+}
+
+// reencrypt encrypts every file of the digest again under s.passphrase, the new
+// passphrase, once old, the passphrase it replaces, is shown to be the one it was
+// sealed under; a file sealed under neither is an error, and stops it
+//
+// each file is recorded as it's done, its new chunks written before its old ones
+// are removed, so an interrupted reencrypt is run again to finish: files already
+// under the new passphrase are skipped, or recorded if they were sealed but not yet
+// recorded; no chunk is kept, so nothing is left sealed under what the old
+// passphrase opens
+func (s *serv) reencrypt(old []byte) error {
+	if bytes.Equal(old, s.passphrase) {
+		return fmt.Errorf("the passphrase is still the old one")
+	}
+	s.reseal = true
+	names := []string{}
+	for name := range s.digest.Snapshot() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var n int
+	for _, name := range names {
+		meta, err := readMeta(name)
+		if err != nil { return err }
+		done, err := sealedUnder(meta, s.passphrase)
+		if err != nil { return fmt.Errorf("%s: %v", name, err) }
+		if done && sameChunks(s.manifest[name], meta) {
+			logf(verbose, "%s is already under the new passphrase\n", name)
+			continue
+		}
+		if !done {
+			ok, err := sealedUnder(meta, old)
+			if err != nil { return fmt.Errorf("%s: %v", name, err) }
+			if !ok {
+				return fmt.Errorf("%s isn't sealed under the old passphrase (%w)", name, ErrAuthFailed)
+			}
+		}
+		err = s.encrypt(name)
+		if err != nil { return err }
+		n++
+	}
+	logf(normal, "%d files encrypted again under the new passphrase\n", n)
+	return nil
+}
+
+// encryptAll encrypts every file of secret/ again, each recorded in the digest in place
+// of what it had, so a rescan cut short leaves every file as either of them; files
+// gone from secret/ are left in the digest for -prune
+func (s *serv) encryptAll() error {
+	s.rescan, s.since = true, 0
+	counters := []*int64{&metrics.filesEncrypted, &metrics.chunksWritten, &metrics.chunksKept}
+	before := make([]int64, len(counters))
+	for i, c := range counters {
+		before[i] = atomic.LoadInt64(c)
+	}
+	err := s.scan(context.Background())
+	n := make([]int64, len(counters))
+	for i, c := range counters {
+		n[i] = atomic.LoadInt64(c) - before[i]
+	}
+	logf(normal, "%d files encrypted again, %d chunks written and %d kept as they were\n", n[0], n[1], n[2])
+	return err
+}
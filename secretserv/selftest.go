@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// selftest encrypts a known payload in a temporary secret/ and crypt/ with keys of
+// its own and decrypts it again, checking that what comes back is the payload,
+// that crypt/ verifies and that a changed chunk is caught; the real secret/ and
+// crypt/ are never touched
+func selftest() error {
+	tmp, err := ioutil.TempDir("", "serv-selftest-")
+	if err != nil { return err }
+	defer os.RemoveAll(tmp)
+	defer func(s, c string) { secretDir, cryptDir = s, c }(secretDir, cryptDir)
+	secretDir, cryptDir = filepath.Join(tmp, "secret"), filepath.Join(tmp, "crypt")
+
+	const passphrase = "serv selftest"
+	defer func(p string, ok bool) {
+		if ok {
+			os.Setenv(passphraseEnv, p)
+		} else {
+			os.Unsetenv(passphraseEnv)
+		}
+	}(os.LookupEnv(passphraseEnv))
+	os.Setenv(passphraseEnv, passphrase)
+
+	step := func(what string, err error) error {
+		if err != nil {
+			return fmt.Errorf("selftest failed %s: %w", what, err)
+		}
+		logf(normal, "selftest: %s ok\n", what)
+		return nil
+	}
+
+	err = os.MkdirAll(secretDir, 0700)
+	if err == nil {
+		err = os.MkdirAll(cryptDir, 0700)
+	}
+	if err := step("making directories", err); err != nil { return err }
+	if err := step("generating keys", generateSrvKeys(0, false)); err != nil { return err }
+	srvKeys, err := openKeyProvider(0)
+	if err := step("reading keys", err); err != nil { return err }
+	defer srvKeys.Close()
+
+	// a few chunks of a payload that doesn't compress, with a partial chunk last
+	payload := make([]byte, 0, 3*chunkSize+17)
+	for i := uint64(0); len(payload) < cap(payload); i++ {
+		b := [8]byte{}
+		binary.BigEndian.PutUint64(b[:], i)
+		sum := sha256.Sum256(b[:])
+		payload = append(payload, sum[:]...)
+	}
+	payload = payload[:cap(payload)]
+	const name = "selftest.bin"
+	if err := step("writing payload", atomicWrite(secretPath(name), payload, 0600)); err != nil { return err }
+
+	s := &serv{
+		keys: srvKeys,
+		passphrase: []byte(passphrase),
+		kdf: secretary.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1},
+		jobs: 1,
+		compress: true,
+		digest: newDigest(),
+		manifest: Manifest{},
+	}
+	if err := step("encrypting", s.encrypt(name)); err != nil { return err }
+
+	got, err := decryptFile(name)
+	if err == nil && !bytes.Equal(got, payload) {
+		err = fmt.Errorf("decrypted %d bytes that aren't the payload", len(got))
+	}
+	if err := step("decrypting", err); err != nil { return err }
+
+	ok, err := verify(s.digest, s.manifest, ioutil.Discard)
+	if err == nil && !ok {
+		err = fmt.Errorf("%s is inconsistent", cryptDir)
+	}
+	if err := step("verifying", err); err != nil { return err }
+
+	p := chunkPath(name, s.manifest[name][0])
+	b, err := ioutil.ReadFile(p)
+	if err == nil {
+		b[len(b)-1] ^= 1
+		err = ioutil.WriteFile(p, b, 0600)
+	}
+	if err == nil {
+		_, err = decryptFile(name)
+		switch {
+		case errors.Is(err, ErrAuthFailed):
+			err = nil
+		case err == nil:
+			err = fmt.Errorf("a changed chunk decrypted")
+		}
+	}
+	if err := step("rejecting a changed chunk", err); err != nil { return err }
+	logf(quiet, "selftest passed\n")
+	return nil
+}
@@ -8,111 +8,590 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
-	crypto_rand "crypto/rand"
-	"io"
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"golang.org/x/crypto/nacl/box"
 	"github.com/rugrah/ru/secretary"
 )
 
 type (
-	key *[32]byte
+	key = secretary.Key
 	keyPair struct{
 		pub key
 		prv key
+		version int
+	}
+
+	// serv encrypts the files of secret/ into crypt/
+	serv struct{
+		keys KeyProvider
+		passphrase []byte
+		kdf secretary.KDFParams
+		jobs int
+		// inFlight bounds the bytes of the files the jobs encrypt at once, if set
+		inFlight *budget
+		// batch is how quiet secret/ must be for the changes made to it to be
+		// encrypted, all at once
+		batch time.Duration
+		// settle is how long a changed file's size and mtime must hold before it's
+		// encrypted, as it may still be being written
+		settle time.Duration
+		// since limits scans to files modified this recently, and those not
+		// yet in the digest, if set
+		since time.Duration
+		compress bool
+		// trustMtime skips summing files whose size and mtime are as the digest
+		// records them
+		trustMtime bool
+		// rescan has scan encrypt every file, as if the digest were empty
+		rescan bool
+		// reseal seals every chunk anew rather than keeping those of the version
+		// of its file before
+		reseal bool
+		// showProgress has scan tell of its progress, see progress
+		showProgress bool
+		progress *progress
+		// followSymlinks follows symlinks within secret/, see walkFollowing
+		followSymlinks bool
+		// cdc chunks files by content rather than in chunkSize pieces, if set
+		cdc *cdc
+		// escrow is the recovery key each file's recipient key is sealed to, if set
+		escrow key
+		// recipients are the public keys each file's recipient key is sealed to
+		recipients []recipient
+		ignore ignoreRules
+		logJSON bool
+		// audit appends every file encrypted or pruned to crypt/audit.log, if set
+		audit bool
+		digest *Digest
+		manifest Manifest
 	}
 )
 
-// generateSrvKeys generates the server's persistent keypair
-func generateSrvKeys() error {
-	pub, prv, err := box.GenerateKey(crypto_rand.Reader)
+// Close wipes both keys of the pair
+func (kp *keyPair) Close() {
+	secretary.Zero(kp.pub)
+	secretary.Zero(kp.prv)
+}
+
+// keyFile is the name in secret/ of the server's pub or prv key of version
+//
+// keys are versioned so they can be rotated, each file's metadata records the
+// version it was sealed with; version 0 is the unversioned serv_pub.asc and
+// serv_prv.asc from before rotation
+func keyFile(kind string, version int) string {
+	if version == 0 {
+		return "serv_" + kind + ".asc"
+	}
+	return fmt.Sprintf("serv_%s.v%d.asc", kind, version)
+}
+
+// keyVersionFile in secret/ records the current version of the server's keys,
+// the one new encryptions use
+const keyVersionFile = "serv_key_version"
+
+// currentKeyVersion reads the version of the server's keys new encryptions use,
+// before any rotation it is 0
+func currentKeyVersion() (int, error) {
+	b, err := ioutil.ReadFile(srvPath(keyVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil { return 0, err }
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad %s: %q", keyVersionFile, b)
+	}
+	return v, nil
+}
+
+// generateSrvKeys generates the server's persistent keypair of version
+//
+// it refuses to replace keys that already exist, everything they sealed would be
+// lost with them, unless forced; forced, the keys replaced are kept as .bak
+func generateSrvKeys(version int, force bool) error {
+	for _, kind := range []string{"prv", "pub"} {
+		p := srvPath(keyFile(kind, version))
+		_, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil { return err }
+		if !force {
+			return fmt.Errorf("%s already exists, replacing it loses everything it sealed; use -force to replace it anyway", keyFile(kind, version))
+		}
+		_, err = os.Lstat(p + ".bak")
+		if err == nil {
+			return fmt.Errorf("%s.bak already exists, move it somewhere safe first", keyFile(kind, version))
+		}
+		fmt.Fprintf(os.Stderr, "warning: replacing %s, whatever it sealed can't be decrypted without %s.bak\n",
+			keyFile(kind, version), keyFile(kind, version))
+		err = os.Rename(p, p+".bak")
+		if err != nil { return err }
+	}
+
+	pub, prv, err := secretary.GenerateKey()
 	if err != nil {	return err }
+	defer secretary.Zero(prv)
 
-	b := make([]byte, 32, 32)
-	copy(b[:], prv[:])
-	err = ioutil.WriteFile("secret/serv_prv.asc", b, 0400)
+	err = writeKey(srvPath(keyFile("prv", version)), prv, true, 0400)
 	if err != nil { return err }
-	fmt.Printf("generated serv_prv.asc: %x\n", prv)
+	fmt.Printf("generated %s\n", keyFile("prv", version))
 
-	copy(b[:], pub[:])
-	err = ioutil.WriteFile("secret/serv_pub.asc", b, 0400)
+	err = writeKey(srvPath(keyFile("pub", version)), pub, false, 0400)
 	if err != nil { return err }
-	fmt.Printf("generated serv_pub.asc: %x\n", pub)
+	fmt.Printf("generated %s: %x\n", keyFile("pub", version), pub)
+	fmt.Printf("fingerprint %s\n", fingerprint(pub))
 	return nil
 }
 
-// readSrvKeys reads the server's keys from disk
-func readSrvKeys() (*keyPair, error) {
-	b, err := ioutil.ReadFile("secret/serv_pub.asc")
-	if err != nil { return nil, err }
-	if len(b) != 32 {
-		return nil, fmt.Errorf("bad length of pub key %d", len(b))
+// fingerprint is a short name for the public key pub, to compare copies of it out
+// of band: the first 8 bytes of its sha256 as colon-separated hex
+func fingerprint(pub key) string {
+	sum := sha256.Sum256(pub[:])
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = hex.EncodeToString(sum[i : i+1])
 	}
-	pub := [32]byte{}
-	copy(pub[:], b[:])
-	fmt.Printf("read serv_pub.asc: %x\n", pub)
+	return strings.Join(parts, ":")
+}
 
-	b, err = ioutil.ReadFile("secret/serv_prv.asc")
-	if err != nil { return nil, err }
-	if len(b) != 32 {
-		return nil, fmt.Errorf("bad length of prv key %d", len(b))
+// checkDirs explains a missing secret/, which would be missing the server's keys
+// too, and creates a missing crypt/, which only needs to be there
+func checkDirs() error {
+	_, err := os.Stat(secretDir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: there's no %s for them and the secrets, run 'serv keygen' to create it", ErrNoSrvKeys, secretDir)
 	}
-	prv := [32]byte{}
-	copy(prv[:], b[:])
-	fmt.Printf("read serv_prv.asc: %x\n", prv)
+	if err != nil { return err }
+	_, err = os.Stat(cryptDir)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(cryptDir, 0700)
+		if err != nil { return err }
+		logf(normal, "created %s\n", cryptDir)
+		return nil
+	}
+	return err
+}
 
-	return &keyPair{pub: &pub, prv: &prv}, nil
+// keygen bootstraps a store, making secret/ and crypt/ readable only by their owner
+// if they're missing and generating the server's keys, which it never replaces
+// unless forced
+func keygen(force bool) error {
+	for _, dir := range []string{secretDir, cryptDir} {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil { return err }
+	}
+	v, err := currentKeyVersion()
+	if err != nil { return err }
+	return generateSrvKeys(v, force)
+}
+
+// rotateKeys generates the next version of the server's keys and makes it current,
+// the keys of earlier versions are kept to decrypt what they sealed
+func rotateKeys() (int, error) {
+	v, err := currentKeyVersion()
+	if err != nil { return 0, err }
+	v++
+	err = generateSrvKeys(v, false)
+	if err != nil { return 0, err }
+	return v, atomicWrite(srvPath(keyVersionFile), []byte(strconv.Itoa(v)+"\n"), 0600)
+}
+
+// checkPerms refuses a private key file readable by anyone but its owner, as happens
+// when keys are copied around without their restrictive permissions
+func checkPerms(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w %s", ErrKeyNotFound, path)
+	}
+	if err != nil { return err }
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("insecure permissions on %s: %#o", filepath.Base(path), perm)
+	}
+	return nil
+}
+
+// readSrvKeys reads the server's keys of version from disk
+func readSrvKeys(version int) (*keyPair, error) {
+	pubFile, prvFile := keyFile("pub", version), keyFile("prv", version)
+	pub, err := readKeyFile(srvPath(pubFile), false)
+	if err != nil { return nil, err }
+	defer secretary.Wipe(pub)
+	prv, err := readKeyFile(srvPath(prvFile), true)
+	if err != nil { return nil, err }
+	defer secretary.Wipe(prv)
+
+	kp, err := parseKeyPair(pub, prv, srvPath(pubFile), srvPath(prvFile))
+	if err != nil { return nil, err }
+	kp.version = version
+	logf(verbose, "read %s: %x\n", pubFile, kp.pub[:])
+	logf(normal, "fingerprint %s\n", fingerprint(kp.pub))
+	logf(verbose, "read %s\n", prvFile)
+	return kp, nil
+}
+
+var (
+	encryptName = flag.String("encrypt", "", "encrypt `file` from secret/ into crypt/")
+	decryptName = flag.String("decrypt", "", "decrypt `file` from crypt/ and write it to stdout")
+	kdfTime = flag.Uint("kdf-time", uint(secretary.DefaultKDF.Time), "argon2id passes over the memory when stretching the passphrase")
+	kdfMemory = flag.Uint("kdf-memory", uint(secretary.DefaultKDF.Memory), "argon2id memory in KiB when stretching the passphrase")
+	kdfThreads = flag.Uint("kdf-threads", uint(secretary.DefaultKDF.Threads), "argon2id threads when stretching the passphrase")
+	jobs = flag.Int("jobs", runtime.NumCPU(), "encrypt up to `N` files at once")
+	maxInFlight = flag.Int64("max-inflight", 256 << 20, "only start encrypting another file while those being encrypted total under `bytes`, 0 for no limit")
+	since = flag.Duration("since", 0, "only scan the files of secret/ modified in the last `duration`, and those never encrypted")
+	batchWindow = flag.Duration("batch", 500*time.Millisecond, "encrypt the files changed in secret/ together once it's been quiet for `duration`")
+	settle = flag.Duration("settle", time.Second, "only encrypt a changed file once its size and mtime have held for `duration`, so it's not sealed half written")
+	trustMtime = flag.Bool("trust-mtime", false, "take files whose size and mtime are as when last encrypted to be unchanged without summing them, which is faster but misses changes that keep both")
+	followSymlinks = flag.Bool("follow-symlinks", false, "follow symlinks in secret/ to what they point to, as long as it's in secret/ too, naming files by their links")
+	compress = flag.Bool("compress", true, "deflate files before sealing them, unless they don't shrink")
+	insecurePerms = flag.Bool("insecure-perms", false, "read serv_prv.asc even if others may read it")
+	dryRun = flag.Bool("dry-run", false, "report which files would be encrypted, without writing anything")
+	showProgress = flag.Bool("progress", false, "tell of how many of the files of secret/ the first scan has done, on a line of its own redrawn on a terminal")
+	logJSON = flag.Bool("log-json", false, "log each file handled as a line of JSON on stdout")
+	auditOps = flag.Bool("audit", false, "append every file encrypted or pruned to crypt/audit.log, each line chained to the one before by its hash")
+	verifyAuditLog = flag.Bool("verify-audit", false, "check the chain of crypt/audit.log, exiting 1 if broken")
+	verifyStore = flag.Bool("verify", false, "check the chunks of crypt/ against manifest.json, exiting 1 if inconsistent")
+	rotate = flag.Bool("rotate-keys", false, "generate the next version of the server's keys and make it current")
+	force = flag.Bool("force", false, "replace existing keys with -gen-keys or keygen, replace crypt/ and metadata with -import, and -prune files even when all of secret/ is gone; it never overrides a running serv's lock")
+	contentChunks = flag.Bool("cdc", false, "cut files into chunks by their content instead of every 64KiB")
+	chunkMin = flag.Int("chunk-min", 16 << 10, "smallest content-defined chunk in `bytes`")
+	chunkAvg = flag.Int("chunk-avg", 64 << 10, "average content-defined chunk in `bytes`, a power of 2")
+	chunkMax = flag.Int("chunk-max", 256 << 10, "largest content-defined chunk in `bytes`")
+	escrowKey = flag.String("escrow", "", "seal each file's key to the recovery public key in `file` too")
+	recoveryKey = flag.String("recovery-key", "", "decrypt with the recovery private key in `file` instead of the passphrase")
+	genRecovery = flag.String("gen-recovery-key", "", "generate a keypair for -escrow or -recipients into `file` and file.pub")
+	showFingerprint = flag.Bool("fingerprint", false, "print the fingerprint of the server's current public key")
+	keyFormat = flag.String("key-format", keyArmor, "write generated keys as raw, base64 or armor")
+	keyProvider = flag.String("key-provider", providerFile, "read the server's private key from its file in secret/, the macOS keychain or pkcs11")
+	quietLog = flag.Bool("quiet", false, "tell of nothing on stderr but warnings and errors")
+	verboseLog = flag.Bool("v", false, "tell of more on stderr, such as unchanged files")
+	metricsAddr = flag.String("metrics-addr", "", "serve Prometheus metrics at http://`addr`/metrics while watching, on localhost if addr is only :port")
+	tuneSample = flag.String("tune", "", "encrypt `file` with chunks of several sizes in a temporary directory, reporting how each does and recommending one")
+	selfTest = flag.Bool("selftest", false, "encrypt and decrypt a known payload in a temporary directory, exiting 1 on any failure")
+	recipientsFile = flag.String("recipients", "", "seal each file's key to every public key listed in `file` too")
+	recipientsDir = flag.String("recipients-dir", "", "seal each file's key to the public key of every *.pub file in `dir` too, read again before each pass")
+	identity = flag.String("identity", "", "decrypt with the private key in `file`, one of -recipients, instead of the passphrase")
+	rewrapKeys = flag.Bool("rewrap", false, "seal the key of every file to the -recipients afresh, without encrypting them again")
+	reencrypt = flag.Bool("reencrypt", false, "encrypt every file again under the passphrase, once the old one of $RU_OLD_PASSPHRASE opens it")
+	rescanAll = flag.Bool("rescan", false, "encrypt every file of secret/ again whatever crypt/digest.json says of it, for when it can't be trusted")
+	exportFile = flag.String("export", "", "write crypt/ and the metadata of its files to the tar `archive`, while no serv runs")
+	importFile = flag.String("import", "", "restore crypt/ and the metadata of its files from the tar `archive` of -export, into an empty crypt/ unless -force")
+	pruneFiles = flag.Bool("prune", false, "drop the files gone from secret/ from crypt/, for good, only listing them with -dry-run")
+	configFile = flag.String("config", "", "read settings from the JSON `file`, which the flags given override")
+	genKeys = flag.Bool("gen-keys", false, "generate the server's keys, refusing to replace existing ones unless -force")
+	showVersion = flag.Bool("version", false, "print the versions of serv, secretary and the formats they write")
+	showStatus = flag.Bool("status", false, "report whether serv is running and what crypt/ holds, exiting 1 if not running")
+	chunkDiffName = flag.String("chunkdiff", "", "count the chunks `file` gained, lost and kept when it was last encrypted, from the manifests alone")
+	collect = flag.Bool("gc", false, "remove the chunks of crypt/ no file references any longer, only listing them with -dry-run")
+)
+
+func init() {
+	flag.StringVar(&secretDir, "secret-dir", secretDir, "`dir` of the secrets and the server's keys")
+	flag.StringVar(&cryptDir, "crypt-dir", cryptDir, "`dir` to encrypt the secrets into")
 }
 
 func main() {
-	fmt.Printf("serv starting %q..\n", secretary.Hello("foo.asc"))
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), `usage: serv [flags]
+       serv [flags] keygen [-force]
+       serv [flags] encrypt [-to pub] [-in path] [-out path]
+       serv [flags] decrypt [-key prv] [-from pub] [-in path] [-out path]
+       serv [flags] seal [-to pub] < plaintext > sealed
+       serv [flags] open [-key prv] [-from pub] < sealed > plaintext
+
+encrypt and seal seal to the server's own public key unless -to, and decrypt and
+open open with the server's own keys unless -key; seal and open are encrypt and
+decrypt of stdin to stdout, for pipes.
+
+serv exits 3 when what it opens isn't authentic, 4 when another serv is running,
+5 when there are no server keys yet, before 'serv keygen', and 1 on any other
+failure.
+
+flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "serv: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// run does what the flags ask, returning once done or, when watching, stopped;
+// main reports its error so deferred cleanup like removing the lock still happens
+func run() error {
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil { return err }
+		err = c.apply()
+		if err != nil { return err }
+	}
+
+	switch {
+	case *quietLog && *verboseLog:
+		return fmt.Errorf("-quiet and -v are exclusive")
+	case *quietLog:
+		verbosity = quiet
+	case *verboseLog:
+		verbosity = verbose
+	}
+
+	if *showVersion {
+		printVersion(os.Stdout)
+		return nil
+	}
+	if *selfTest {
+		return selftest()
+	}
+	if *tuneSample != "" {
+		return tune(*tuneSample, os.Stdout)
+	}
+
+	if flag.Arg(0) == "keygen" {
+		fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+		force := fs.Bool("force", false, "replace the keys if there are some, keeping them as .bak")
+		fs.Parse(flag.Args()[1:])
+		return keygen(*force)
+	}
+	if flag.NArg() > 0 {
+		return oneShot(flag.Arg(0), flag.Args()[1:])
+	}
+	switch *keyFormat {
+	case keyRaw, keyBase64, keyArmor:
+	default:
+		return fmt.Errorf("unknown -key-format %q, want %s, %s or %s", *keyFormat, keyRaw, keyBase64, keyArmor)
+	}
+
+	if *decryptName != "" {
+		return decryptTo(os.Stdout, *decryptName)
+	}
+
+	if *verifyAuditLog {
+		ok, err := verifyAudit(os.Stdout)
+		if err != nil { return err }
+		if !ok {
+			return fmt.Errorf("%s is broken", auditPath())
+		}
+		return nil
+	}
+
+	if *exportFile != "" {
+		return exportCrypt(*exportFile)
+	}
+	if *importFile != "" {
+		return importCrypt(*importFile, *force)
+	}
+
+	if *verifyStore {
+		digest, err := loadDigest()
+		if err != nil { return err }
+		manifest, err := loadManifest(digest)
+		if err != nil { return err }
+		ok, err := verify(digest, manifest, os.Stdout)
+		if err != nil { return err }
+		if !ok {
+			return fmt.Errorf("%s is inconsistent", cryptDir)
+		}
+		return nil
+	}
+
+	if *chunkDiffName != "" {
+		return chunkDiff(*chunkDiffName, os.Stdout)
+	}
+
+	if *showFingerprint {
+		v, err := currentKeyVersion()
+		if err != nil { return err }
+		pub, err := readKey(srvPath(keyFile("pub", v)), false)
+		if err != nil { return err }
+		fmt.Println(fingerprint(pub))
+		return nil
+	}
 
-	// panic(generateSrvKeys())
+	if *genKeys {
+		return keygen(*force)
+	}
+
+	if *showStatus {
+		return status(os.Stdout)
+	}
+
+	if *genRecovery != "" {
+		return generateRecoveryKey(*genRecovery)
+	}
+
+	if *collect {
+		digest, err := loadDigest()
+		if err != nil { return err }
+		manifest, err := loadManifest(digest)
+		if err != nil { return err }
+		// a running serv writes chunks before listing them in the manifest
+		if !*dryRun {
+			err = acquireLock()
+			if err != nil { return err }
+			defer releaseLock()
+		}
+		return gc(manifest, *dryRun, os.Stdout)
+	}
+
+	if *dryRun {
+		digest, err := loadDigest()
+		if err != nil { return err }
+		ignore, err := loadIgnore()
+		if err != nil { return err }
+		s := &serv{ignore: ignore, digest: digest, followSymlinks: *followSymlinks}
+		if *pruneFiles {
+			return s.pruneDeleted(true, os.Stdout)
+		}
+		return s.dryRun(os.Stdout)
+	}
+
+	err := checkDirs()
+	if err != nil { return err }
+	logf(normal, "serv starting..\n")
 
 	// read the server's keys from disk, these are used as the sender for all AEAD encryption
 	//
 	// the recipient keys are unique per-file, generated by salsa XOR'ing together sha256 sum
 	// of file with the shared passphrase for all files
 	//
-	// this (sender, receiver) keypairs produces chunks of AEAD data, to be stored in files named
-	// after checksum of each chunk, with metadata stored in secret/ and recovered same way as
-	// server keys
-	srvKeys, err := readSrvKeys()
-	if err != nil { panic(err) }
+	// this (sender, receiver) keypairs seals a random content key per file version, under
+	// which chunks of AEAD data are produced, to be stored in files named after checksum of
+	// each chunk, with metadata stored in secret/ and recovered same way as server keys
+	if *rotate {
+		v, err := rotateKeys()
+		if err != nil { return err }
+		fmt.Printf("server keys are now version %d\n", v)
+		return nil
+	}
 
-	recipientPublicKey, recipientPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
-	if err != nil {
-		panic(err)
+	version, err := currentKeyVersion()
+	if err != nil { return err }
+	srvKeys, err := openKeyProvider(version)
+	if err != nil { return err }
+	defer srvKeys.Close()
+	passphrase, err := readPassphrase()
+	if err != nil { return err }
+	defer secretary.Wipe(passphrase)
+
+	err = acquireLock()
+	if err != nil { return err }
+	defer releaseLock()
+
+	digest, err := loadTrustedDigest(srvKeys)
+	if err != nil && *rescanAll {
+		fmt.Fprintf(os.Stderr, "warning: %v; -rescan makes it anew\n", err)
+		digest, err = newDigest(), nil
+	}
+	if err != nil { return err }
+	manifest, err := loadManifest(digest)
+	if err != nil { return err }
+	ignore, err := loadIgnore()
+	if err != nil { return err }
+	if *jobs < 1 {
+		return fmt.Errorf("bad -jobs %d", *jobs)
+	}
+	if *maxInFlight < 0 {
+		return fmt.Errorf("bad -max-inflight %d", *maxInFlight)
+	}
+	if *since < 0 {
+		return fmt.Errorf("bad -since %v", *since)
+	}
+	if *batchWindow <= 0 {
+		return fmt.Errorf("bad -batch %v", *batchWindow)
+	}
+	if *settle < 0 {
+		return fmt.Errorf("bad -settle %v", *settle)
+	}
+	if *kdfTime < 1 || *kdfThreads < 1 || *kdfThreads > 255 {
+		return fmt.Errorf("bad argon2id params: -kdf-time %d -kdf-threads %d", *kdfTime, *kdfThreads)
+	}
+	var escrow key
+	if *escrowKey != "" {
+		escrow, err = readKey(*escrowKey, false)
+		if err != nil { return err }
+	}
+	recipients, err := loadRecipients()
+	if err != nil { return err }
+	if *rewrapKeys && len(recipients) == 0 {
+		return fmt.Errorf("-rewrap needs -recipients or -recipients-dir")
+	}
+	var chunker *cdc
+	if *contentChunks {
+		chunker, err = newCDC(*chunkMin, *chunkAvg, *chunkMax)
+		if err != nil { return err }
+	}
+	s := &serv{
+		keys: srvKeys,
+		passphrase: passphrase,
+		kdf: secretary.KDFParams{Time: uint32(*kdfTime), Memory: uint32(*kdfMemory), Threads: uint8(*kdfThreads)},
+		jobs: *jobs,
+		inFlight: newBudget(*maxInFlight),
+		batch: *batchWindow,
+		settle: *settle,
+		since: *since,
+		compress: *compress,
+		trustMtime: *trustMtime,
+		followSymlinks: *followSymlinks,
+		cdc: chunker,
+		escrow: escrow,
+		recipients: recipients,
+		ignore: ignore,
+		logJSON: *logJSON,
+		showProgress: *showProgress,
+		audit: *auditOps,
+		digest: digest,
+		manifest: manifest,
 	}
 
-	// we must use a different nonce for each message you encrypt with the
-	// same key
-	//
-	// since the nonce here is 192 bits long, a random value
-	// provides a sufficiently small probability of repeats
-	var nonce [24]byte
-	if _, err := io.ReadFull(crypto_rand.Reader, nonce[:]); err != nil {
-		panic(err)
+	if *encryptName != "" {
+		return s.encrypt(*encryptName)
+	}
+	if *rewrapKeys {
+		return s.rewrap()
+	}
+	if *pruneFiles {
+		return s.pruneDeleted(false, os.Stdout)
+	}
+	if *rescanAll {
+		return s.encryptAll()
+	}
+	if *reencrypt {
+		old, err := readPassphraseFrom(oldPassphraseEnv, "old passphrase")
+		if err != nil { return err }
+		defer secretary.Wipe(old)
+		return s.reencrypt(old)
 	}
 
-	msg := []byte("Alas, poor Yorick! I knew him, Horatio")
-	// encrypt msg and append result to nonce
-	encrypted := box.Seal(nonce[:], msg, &nonce, recipientPublicKey, srvKeys.prv)
+	atomic.StoreInt64(&metrics.trackedFiles, int64(s.digest.Len()))
+	if *metricsAddr != "" {
+		srv, err := listenMetrics(*metricsAddr)
+		if err != nil { return err }
+		defer srv.Close()
+	}
 
-	// recipient can decrypt message using their private key and the
-	// sender's public key
-	//
-	// to decrypt, we must use same nonce we used to encrypt message
-	//
-	// one way to achieve this is to store nonce alongside encrypted message
-	var decryptNonce [24]byte
-	copy(decryptNonce[:], encrypted[:24])
-	decrypted, ok := box.Open(nil, encrypted[24:], &decryptNonce, srvKeys.pub, recipientPrivateKey)
-	if !ok {
-		panic("decryption error")
-	}
-	fmt.Println(string(decrypted))
+	// stop watching on SIGINT or SIGTERM, letting the deferred cleanup release
+	// the lock
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = s.watch(ctx)
+	if err != nil { return err }
+	logf(normal, "serv stopping\n")
+	return nil
 }
-
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// testPassphrase is the passphrase of the stores newTestServ makes
+const testPassphrase = "serv test"
+
+// newTestServ makes a store in a temporary directory for tb, with keys of its own and
+// testPassphrase in $RU_PASSPHRASE, returning a serv that encrypts into it; secret/,
+// crypt/ and the environment are as they were once tb is done
+func newTestServ(tb testing.TB) *serv {
+	tb.Helper()
+	tmp := tb.TempDir()
+	secret, crypt, v := secretDir, cryptDir, verbosity
+	p, ok := os.LookupEnv(passphraseEnv)
+	tb.Cleanup(func() {
+		secretDir, cryptDir, verbosity = secret, crypt, v
+		if ok {
+			os.Setenv(passphraseEnv, p)
+		} else {
+			os.Unsetenv(passphraseEnv)
+		}
+	})
+	secretDir, cryptDir = filepath.Join(tmp, "secret"), filepath.Join(tmp, "crypt")
+	verbosity = quiet
+	os.Setenv(passphraseEnv, testPassphrase)
+	for _, dir := range []string{secretDir, cryptDir} {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil { tb.Fatal(err) }
+	}
+	// generating keys tells of them on stdout, which would garble benchmarks
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	err := generateSrvKeys(0, false)
+	os.Stdout.Close()
+	os.Stdout = stdout
+	if err != nil { tb.Fatal(err) }
+	keys, err := openKeyProvider(0)
+	if err != nil { tb.Fatal(err) }
+	tb.Cleanup(keys.Close)
+	return &serv{
+		keys: keys,
+		passphrase: []byte(testPassphrase),
+		kdf: secretary.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1},
+		jobs: 1,
+		compress: true,
+		digest: newDigest(),
+		manifest: Manifest{},
+	}
+}
+
+// writeSecret writes b to secret/<name>
+func writeSecret(tb testing.TB, name string, b []byte) {
+	tb.Helper()
+	err := os.MkdirAll(filepath.Dir(secretPath(name)), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(secretPath(name), b, 0600)
+	}
+	if err != nil { tb.Fatal(err) }
+}
+
+// noise is n bytes that don't compress, the same n bytes every time
+func noise(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestFingerprint(t *testing.T) {
+	zero, counting := &[32]byte{}, &[32]byte{}
+	for i := range counting {
+		counting[i] = byte(i)
+	}
+	for _, c := range []struct{
+		pub key
+		want string
+	}{
+		{zero, "66:68:7a:ad:f8:62:bd:77"},
+		{counting, "63:0d:cd:29:66:c4:33:66"},
+	} {
+		if got := fingerprint(c.pub); got != c.want {
+			t.Errorf("fingerprint of %x is %s, want %s", c.pub[:], got, c.want)
+		}
+	}
+}
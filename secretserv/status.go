@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// status reports to w whether a serv holds crypt/.lock, for how long
+// it's been running, and what crypt/ holds: the files of the digest, the bytes of
+// their chunks and when one was last encrypted
+func status(w io.Writer) error {
+	l, err := lockHolder()
+	if err != nil { return err }
+	if l == nil {
+		return fmt.Errorf("not running, no serv holds %s", lockPath())
+	}
+	fmt.Fprintf(w, "running as pid %d since %s, up %s\n",
+		l.PID, l.Started.Format(time.RFC3339), time.Since(l.Started).Round(time.Second))
+
+	d, err := loadDigest()
+	if err != nil { return err }
+	var last time.Time
+	for _, e := range d.Snapshot() {
+		if e.Encrypted.After(last) {
+			last = e.Encrypted
+		}
+	}
+	var size int64
+	err = filepath.WalkDir(cryptDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if !de.Type().IsRegular() || !isChunkName(de.Name()) {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil { return err }
+		size += fi.Size()
+		return nil
+	})
+	if err != nil { return err }
+	fmt.Fprintf(w, "%d files tracked, %d bytes of chunks in %s\n", d.Len(), size, cryptDir)
+	if last.IsZero() {
+		fmt.Fprintf(w, "nothing encrypted yet\n")
+	} else {
+		fmt.Fprintf(w, "last encrypted %s, %s ago\n", last.Format(time.RFC3339), time.Since(last).Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// resolveLink resolves the symlink at p to the path of what it points to and its
+// info, refusing a link that ends up outside secret/, which -follow-symlinks never
+// reaches past, and a link to a file serv skips, such as its keys or metadata,
+// which would otherwise be encrypted by the link's name
+func (s *serv) resolveLink(p string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil { return "", nil, err }
+	root, err := filepath.EvalSymlinks(secretDir)
+	if err != nil { return "", nil, err }
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, fmt.Errorf("it points outside %s", secretDir)
+	}
+	fi, err := os.Stat(target)
+	if err != nil { return "", nil, err }
+	if name := filepath.ToSlash(rel); fi.Mode().IsRegular() && s.skip(name) {
+		return "", nil, fmt.Errorf("it points to %s, which isn't encrypted", name)
+	}
+	return target, fi, nil
+}
+
+// statSecret is os.Lstat of name in secret/ or, under -follow-symlinks, os.Stat of
+// what it points to if it's a symlink, so a file reached through a link is its
+// link's name with its target's contents
+func (s *serv) statSecret(name string) (os.FileInfo, error) {
+	fi, err := os.Lstat(secretPath(name))
+	if err != nil || !s.followSymlinks || fi.Mode()&fs.ModeSymlink == 0 {
+		return fi, err
+	}
+	_, fi, err = s.resolveLink(secretPath(name))
+	return fi, err
+}
+
+// fileID tells directories apart by their device and inode, however they're named
+type fileID struct{
+	dev, ino uint64
+}
+
+func idOf(fi os.FileInfo) fileID {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// walkFollowing is walk under -follow-symlinks: it calls fn with the name of every
+// file to encrypt under dir, the real directory reached by the path at of secret/,
+// following symlinks to files and directories within secret/
+//
+// files are named by the path they're reached by, links included, so removing a
+// link removes what's reached through it; ancestors are the directories being
+// walked, a link to any of them is a loop and isn't followed again
+func (s *serv) walkFollowing(dir, at string, ancestors map[fileID]bool, fn func(name string) error) error {
+	fi, err := os.Stat(dir)
+	if err != nil { return err }
+	id := idOf(fi)
+	if ancestors[id] {
+		name, _ := secretName(at)
+		fmt.Fprintf(os.Stderr, "warning: not following %s, it loops back to a directory it's in\n", name)
+		return nil
+	}
+	ancestors[id] = true
+	defer delete(ancestors, id)
+
+	des, err := os.ReadDir(dir)
+	if err != nil { return err }
+	for _, de := range des {
+		p, via := filepath.Join(dir, de.Name()), filepath.Join(at, de.Name())
+		name, ok := secretName(via)
+		if !ok {
+			continue
+		}
+		isDir, isFile := de.IsDir(), de.Type().IsRegular()
+		if de.Type()&fs.ModeSymlink != 0 {
+			target, tfi, err := s.resolveLink(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: not following %s: %v\n", name, err)
+				continue
+			}
+			p = target
+			isDir, isFile = tfi.IsDir(), tfi.Mode().IsRegular()
+		}
+		switch {
+		case isDir:
+			if s.ignore.match(name + "/") {
+				continue
+			}
+			err = s.walkFollowing(p, via, ancestors, fn)
+		case isFile && !s.skip(name):
+			err = fn(name)
+		}
+		if err != nil { return err }
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkFollowing(t *testing.T) {
+	s := newTestServ(t)
+	s.followSymlinks = true
+	writeSecret(t, "a.txt", []byte("a"))
+	writeSecret(t, "d/b.txt", []byte("b"))
+	writeSecret(t, "d/b.txt.meta.json", []byte("{}"))
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	err := ioutil.WriteFile(outside, []byte("outside"), 0600)
+	if err != nil { t.Fatal(err) }
+	links := map[string]string{
+		"link.txt": "a.txt",
+		"dlink": "d",
+		"d/loop": "..",
+		"escape.txt": outside,
+		"key.txt": keyFile("prv", 0),
+		"meta.txt": "d/b.txt.meta.json",
+		"dangling.txt": "nothing",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, secretPath(name))
+		if err != nil { t.Fatal(err) }
+	}
+
+	names := []string{}
+	err = s.walk(secretDir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil { t.Fatal(err) }
+	sort.Strings(names)
+	want := []string{"a.txt", "d/b.txt", "dlink/b.txt", "link.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("walked %q, want %q", names, want)
+	}
+
+	for _, name := range []string{"escape.txt", "key.txt", "meta.txt", "dangling.txt"} {
+		if _, err := s.statSecret(name); err == nil {
+			t.Errorf("link %s stats as a file to encrypt", name)
+		}
+	}
+	fi, err := s.statSecret("link.txt")
+	if err != nil || fi.Size() != 1 {
+		t.Errorf("link.txt: %v, %v", fi, err)
+	}
+}
+
+func TestWalkNotFollowing(t *testing.T) {
+	s := newTestServ(t)
+	writeSecret(t, "a.txt", []byte("a"))
+	err := os.Symlink("a.txt", secretPath("link.txt"))
+	if err != nil { t.Fatal(err) }
+	names := []string{}
+	err = s.walk(secretDir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Errorf("walked %q without -follow-symlinks", names)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// tuneRounds is how many times tune encrypts the sample with each chunking
+const tuneRounds = 3
+
+// a chunking tune tries, nil cdc being the fixed chunks of chunkSize
+type chunking struct{
+	name string
+	cdc *cdc
+}
+
+// tuneResult is how a chunking did with the sample: how long encrypting it took, the
+// chunks it was cut into and their bytes, and the share of them kept after an edit
+type tuneResult struct{
+	chunking
+	took time.Duration
+	chunks int
+	size int64
+	kept float64
+}
+
+// tune encrypts the file at sample with fixed chunks and content-defined chunks of
+// several sizes, in a temporary secret/ and crypt/ with keys of its own as selftest
+// does, reporting to w a table of how each did and recommending one; each is timed
+// at its fastest of tuneRounds
+//
+// the size ratio is of the chunks to the sample, it's under 1 for a sample that
+// compresses, unless -compress=false
+//
+// what's traded is the cost of sealing each chunk and the store's number of files
+// against how much of a file an edit leaves in crypt/ as it was, see cdc, measured
+// as the share of chunks kept once a byte is inserted in the middle of the sample;
+// the recommendation is the chunking of fewest chunks of those at least nine tenths
+// as fast as the fastest
+func tune(sample string, w io.Writer) error {
+	fi, err := os.Stat(sample)
+	if err != nil { return err }
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return fmt.Errorf("%s isn't a regular file with anything in it", sample)
+	}
+
+	tmp, err := ioutil.TempDir("", "serv-tune-")
+	if err != nil { return err }
+	defer os.RemoveAll(tmp)
+	defer func(s, c string) { secretDir, cryptDir = s, c }(secretDir, cryptDir)
+	defer func(v int) { verbosity = v }(verbosity)
+	verbosity = quiet
+	secretDir = filepath.Join(tmp, "secret")
+	err = os.MkdirAll(secretDir, 0700)
+	if err != nil { return err }
+	pub, prv, err := secretary.GenerateKey()
+	if err != nil { return err }
+	kp := &keyPair{pub: pub, prv: prv}
+	defer kp.Close()
+
+	chunkings := []chunking{{name: fmt.Sprintf("fixed %s", sizeOf(chunkSize))}}
+	for avg := 16 << 10; avg <= 1<<20; avg <<= 1 {
+		c, err := newCDC(avg/4, avg, avg*4)
+		if err != nil { return err }
+		chunkings = append(chunkings, chunking{name: fmt.Sprintf("cdc avg %s", sizeOf(int64(avg))), cdc: c})
+	}
+
+	const name = "sample"
+	err = copySample(sample, secretPath(name))
+	if err != nil { return err }
+	results := []tuneResult{}
+	for i, c := range chunkings {
+		r := tuneResult{chunking: c}
+		for round := 0; round < tuneRounds; round++ {
+			// a crypt/ of its own every round, or the chunks would already be there
+			cryptDir = filepath.Join(tmp, fmt.Sprintf("crypt%d.%d", i, round))
+			took, s, err := tuneRound(kp, c, name)
+			if err != nil { return err }
+			if round == 0 || took < r.took {
+				r.took = took
+			}
+			r.chunks, r.size = 0, 0
+			for _, sum := range s.manifest[name] {
+				r.chunks++
+				r.size += chunkFileSize(name, sum)
+			}
+			os.RemoveAll(cryptDir)
+		}
+		cryptDir = filepath.Join(tmp, fmt.Sprintf("crypt%d.edit", i))
+		r.kept, err = tuneEdit(kp, c, name, sample, fi.Size()/2)
+		if err != nil { return err }
+		os.RemoveAll(cryptDir)
+		results = append(results, r)
+	}
+
+	var fastest time.Duration
+	for _, r := range results {
+		if fastest == 0 || r.took < fastest {
+			fastest = r.took
+		}
+	}
+	var best *tuneResult
+	for i, r := range results {
+		if r.took*9 <= fastest*10 && (best == nil || r.chunks < best.chunks) {
+			best = &results[i]
+		}
+	}
+
+	fmt.Fprintf(w, "%s, %s\n\n", sample, sizeOf(fi.Size()))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "chunking\tchunks\tMiB/s\tsize ratio\tkept after edit\t")
+	for _, r := range results {
+		mbs := float64(fi.Size()) / (1 << 20) / (r.took.Seconds() + 1e-9)
+		overhead := 0.0
+		if fi.Size() > 0 {
+			overhead = float64(r.size) / float64(fi.Size())
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.3f\t%.1f%%\t\n", r.name, r.chunks, mbs, overhead, 100*r.kept)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	if best.cdc == nil {
+		fmt.Fprintf(w, "recommended: the default, %s\n", best.name)
+		return nil
+	}
+	fmt.Fprintf(w, "recommended: %s, -cdc -chunk-min %d -chunk-avg %d -chunk-max %d\n", best.name, best.cdc.min, best.cdc.avg, best.cdc.max)
+	return nil
+}
+
+// tuneRound encrypts name with the chunking c into a new crypt/, returning how long
+// it took and the serv that did
+func tuneRound(kp *keyPair, c chunking, name string) (time.Duration, *serv, error) {
+	err := os.MkdirAll(cryptDir, 0700)
+	if err != nil { return 0, nil, err }
+	s := &serv{
+		keys: kp,
+		passphrase: []byte("serv tune"),
+		kdf: secretary.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1},
+		jobs: 1,
+		compress: *compress,
+		cdc: c.cdc,
+		digest: newDigest(),
+		manifest: Manifest{},
+	}
+	start := time.Now()
+	err = s.encrypt(name)
+	return time.Since(start), s, err
+}
+
+// tuneEdit encrypts name with the chunking c into a new crypt/, then again once a
+// byte is inserted at of the sample, returning the share of the chunks of the edited
+// file that were already in crypt/; name is the sample again when it returns
+func tuneEdit(kp *keyPair, c chunking, name, sample string, at int64) (float64, error) {
+	_, s, err := tuneRound(kp, c, name)
+	if err != nil { return 0, err }
+	before := map[string]bool{}
+	for _, sum := range s.manifest[name] {
+		before[sum] = true
+	}
+	err = copyEdited(sample, secretPath(name), at)
+	if err == nil {
+		err = s.encrypt(name)
+	}
+	if err != nil { return 0, err }
+	kept := 0
+	for _, sum := range s.manifest[name] {
+		if before[sum] {
+			kept++
+		}
+	}
+	err = copySample(sample, secretPath(name))
+	if err != nil || len(s.manifest[name]) == 0 {
+		return 0, err
+	}
+	return float64(kept) / float64(len(s.manifest[name])), nil
+}
+
+// copySample copies the file at sample to p
+func copySample(sample, p string) error {
+	return copyEdited(sample, p, -1)
+}
+
+// copyEdited copies the file at sample to p, inserting a byte at offset at unless
+// it's negative
+func copyEdited(sample, p string, at int64) error {
+	in, err := os.Open(sample)
+	if err != nil { return err }
+	defer in.Close()
+	return atomicWriteFrom(p, 0600, func(w io.Writer) error {
+		if at >= 0 {
+			_, err := io.CopyN(w, in, at)
+			if err != nil { return err }
+			_, err = w.Write([]byte{'+'})
+			if err != nil { return err }
+		}
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// chunkFileSize is the size of the chunk sum of name in crypt/, 0 if it's not there
+func chunkFileSize(name, sum string) int64 {
+	fi, err := os.Stat(chunkPath(name, sum))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isCryptFile reports whether name in crypt/ is one of serv's own files rather
+// than a chunk
+func isCryptFile(name string) bool {
+	return name == "digest.json" || name == "digest.json.sig" || name == "manifest.json" || name == "manifest.prev.json" || name == ".lock" || name == "audit.log" || strings.HasPrefix(name, "audit.log.") || strings.HasPrefix(filepath.Base(name), tmpPrefix)
+}
+
+// verify checks every chunk of crypt/ against the manifest, reporting to w each
+// chunk the manifest references that is missing from crypt/ or no longer matches
+// its checksum, each chunk in crypt/ that the manifest doesn't reference, and each
+// file of the digest the manifest doesn't list
+//
+// it reports whether crypt/ is consistent with the digest and manifest
+func verify(d *Digest, m Manifest, w io.Writer) (bool, error) {
+	var missing, mismatched, extra, unlisted, chunks int
+	for name := range d.Snapshot() {
+		if _, ok := m[name]; !ok {
+			unlisted++
+			fmt.Fprintf(w, "unlisted   %s, in %s but not %s\n", name, digestPath(), manifestPath())
+		}
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	referenced := map[string]bool{}
+	for _, name := range names {
+		for _, sum := range m[name] {
+			p := chunkPath(name, sum)
+			if referenced[p] {
+				continue
+			}
+			referenced[p] = true
+			chunks++
+
+			b, err := ioutil.ReadFile(p)
+			if os.IsNotExist(err) {
+				missing++
+				fmt.Fprintf(w, "missing    %s, a chunk of %s\n", p, name)
+				continue
+			}
+			if err != nil { return false, err }
+			got := sha256.Sum256(b)
+			if hex.EncodeToString(got[:]) != sum {
+				mismatched++
+				fmt.Fprintf(w, "mismatched %s, a chunk of %s\n", p, name)
+			}
+		}
+	}
+
+	err := filepath.WalkDir(cryptDir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil { return err }
+		if de.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(cryptDir, p)
+		if err != nil { return err }
+		if isCryptFile(filepath.ToSlash(rel)) || referenced[p] {
+			return nil
+		}
+		extra++
+		fmt.Fprintf(w, "extra      %s, not referenced by %s\n", p, manifestPath())
+		return nil
+	})
+	if err != nil { return false, err }
+
+	if missing+mismatched+extra+unlisted > 0 {
+		fmt.Fprintf(w, "%s is inconsistent: %d missing, %d mismatched, %d extra, %d unlisted\n",
+			cryptDir, missing, mismatched, extra, unlisted)
+		return false, nil
+	}
+	fmt.Fprintf(w, "%s is consistent: %d files, %d chunks\n", cryptDir, len(m), chunks)
+	return true, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/rugrah/ru/secretary"
+)
+
+// printVersion writes the version serv was built as, that of its secretary, and
+// the versions of the frames and metadata they write, which is what tells whether
+// a serv reads what another wrote
+func printVersion(w io.Writer) {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	fmt.Fprintf(w, "serv %s\n", version)
+	fmt.Fprintf(w, "secretary %s\n", secretary.Version)
+	fmt.Fprintf(w, "frame version %d, metadata version %d\n", secretary.FrameVersion, metaVersion)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// isServFile reports whether name in secret/ belongs to serv rather than being
+// a secret to encrypt; names beginning serv_ at the top of secret/ are reserved
+// for the server's keys and passphrase
+func isServFile(name string) bool {
+	if strings.HasPrefix(name, "serv_") || name == ignoreFile {
+		return true
+	}
+	base := path.Base(name)
+	return strings.HasSuffix(base, ".meta.json") || strings.HasPrefix(base, tmpPrefix)
+}
+
+// secretName is the name of the file at p, relative to secret/ and slash separated,
+// or false if p isn't under secret/
+func secretName(p string) (string, bool) {
+	rel, err := filepath.Rel(secretDir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// skip reports whether name, relative to secret/, isn't to be encrypted
+func (s *serv) skip(name string) bool {
+	return isServFile(name) || s.ignore.match(name)
+}
+
+// walk calls fn with the name of every file to encrypt under dir, a directory of
+// secret/; directories, even empty ones, are only descended into and symlinks are
+// never followed, so nothing outside secret/ is reached, unless -follow-symlinks
+// has them followed as far as secret/ goes, see walkFollowing
+func (s *serv) walk(dir string, fn func(name string) error) error {
+	if s.followSymlinks {
+		return s.walkFollowing(dir, dir, map[fileID]bool{}, fn)
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil { return err }
+		name, ok := secretName(p)
+		if ok && d.IsDir() && s.ignore.match(name+"/") {
+			return filepath.SkipDir
+		}
+		if !ok || !d.Type().IsRegular() || s.skip(name) {
+			return nil
+		}
+		return fn(name)
+	})
+}
+
+// errStopped stops a walk early
+var errStopped = errors.New("stopped")
+
+// scan encrypts every file currently under secret/ that changed since it was last
+// encrypted, spread over s.jobs workers, which only start on a file once
+// s.inFlight has room for it
+//
+// the workers only read a copy of the digest's entries, their results are recorded
+// in the digest here, one at a time; the first error stops the scan, and so does
+// cancelling ctx, though the files being encrypted are finished and recorded
+//
+// with s.since, files in the digest last modified before then aren't even read,
+// and with s.rescan the digest is ignored and every file encrypted
+//
+// with s.showProgress, how much of secret/ is done is told of as it goes
+func (s *serv) scan(ctx context.Context) error {
+	if s.showProgress {
+		s.progress = newProgress(s.logJSON)
+		defer func() {
+			s.progress.end()
+			s.progress = nil
+		}()
+	}
+	s.reloadRecipients()
+	prev := s.digest.Snapshot()
+	if s.rescan {
+		prev = map[string]digestEntry{}
+	}
+	cutoff := time.Now().Add(-s.since)
+
+	names := make(chan string)
+	done := make(chan struct{})
+	var walkErr error
+	go func() {
+		defer close(names)
+		defer s.progress.walkedAll()
+		walkErr = s.walk(secretDir, func(name string) error {
+			if _, ok := prev[name]; ok && s.since > 0 {
+				fi, err := s.statSecret(name)
+				if err == nil && fi.ModTime().Before(cutoff) {
+					return nil
+				}
+			}
+			s.progress.found(s.fileSize(name))
+			select {
+			case names <- name:
+				return nil
+			case <-done:
+				return errStopped
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	results := make(chan result)
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				n := s.inFlight.acquire(s.fileSize(name))
+				r := s.check(name, prev[name])
+				s.inFlight.release(n)
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// keep draining after an error, so every worker finishes its file and exits
+	var err error
+	for r := range results {
+		if err != nil {
+			continue
+		}
+		err = s.record(r)
+		if err != nil {
+			close(done)
+		}
+	}
+	if err != nil { return err }
+	return walkErr
+}
+
+// fileState is what of a file shows it's still being written: its size and mtime
+type fileState struct{
+	size int64
+	mtime time.Time
+}
+
+func (s *serv) statFile(name string) (fileState, error) {
+	fi, err := s.statSecret(name)
+	if err != nil { return fileState{}, err }
+	return fileState{size: fi.Size(), mtime: fi.ModTime()}, nil
+}
+
+// settled splits the pending files into those ready to encrypt, whose state is
+// still as seen and which were last modified at least s.settle ago, and those
+// that may still be being written, whose state seen is updated; files no longer
+// there are ready, for updateAll to skip
+func (s *serv) settled(pending map[string]bool, seen map[string]fileState) (ready, unsettled map[string]bool) {
+	ready, unsettled = map[string]bool{}, map[string]bool{}
+	now := time.Now()
+	for name := range pending {
+		st, err := s.statFile(name)
+		prev, ok := seen[name]
+		if err != nil || ok && st.size == prev.size && st.mtime.Equal(prev.mtime) && now.Sub(st.mtime) >= s.settle {
+			ready[name] = true
+			delete(seen, name)
+			continue
+		}
+		logf(verbose, "waiting for %s to settle\n", name)
+		seen[name] = st
+		unsettled[name] = true
+	}
+	return ready, unsettled
+}
+
+// watch encrypts each file under secret/ as it changes, after an initial scan of
+// the files already there, until ctx is cancelled
+//
+// changes are collected until secret/ has gone s.batch without any, then the files
+// changed are encrypted as one batch, each once however often it changed, and the
+// digest saved once for them all; editors often write a file twice when saving it,
+// and build tools rewrite many at once
+//
+// under -follow-symlinks, only changes to the files themselves are watched, those
+// reached through a link are brought up-to-date by the next scan, when serv starts
+//
+// a file is only encrypted once its size and mtime have held for s.settle, a file
+// still being written when the batch is due waits for the next, so what's sealed
+// isn't cut short; large files being copied in need a longer -settle
+//
+// batches are encrypted between events, so once cancelled watch returns without
+// having left any half done
+func (s *serv) watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil { return err }
+	defer w.Close()
+
+	// watches aren't recursive, every directory of secret/ needs its own
+	addWatches := func(dir string) error {
+		return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil { return err }
+			if !d.IsDir() {
+				return nil
+			}
+			return w.Add(p)
+		})
+	}
+
+	// watch before scanning, so a change made during the scan isn't missed
+	err = addWatches(secretDir)
+	if err != nil { return err }
+	err = s.scan(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil { return err }
+
+	pending := map[string]bool{}
+	seen := map[string]fileState{}
+	quiet := time.NewTimer(s.batch)
+	quiet.Stop()
+	defer quiet.Stop()
+	schedule := func(name string) error {
+		pending[name] = true
+		if st, err := s.statFile(name); err == nil {
+			seen[name] = st
+		}
+		if !quiet.Stop() {
+			select {
+			case <-quiet.C:
+			default:
+			}
+		}
+		quiet.Reset(s.batch)
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok { return nil }
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			// only files under secret/, never our own output in crypt/
+			name, ok := secretName(ev.Name)
+			if !ok {
+				continue
+			}
+			if name == ignoreFile {
+				rules, err := loadIgnore()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "keeping previous %s: %v\n", ignoreFile, err)
+					continue
+				}
+				s.ignore = rules
+				continue
+			}
+			if s.skip(name) {
+				continue
+			}
+			fi, err := os.Lstat(ev.Name)
+			if err == nil && fi.IsDir() {
+				// files may land in a new directory before it's watched
+				err = addWatches(ev.Name)
+				if err == nil {
+					err = s.walk(ev.Name, schedule)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "watching %s: %v\n", name, err)
+				}
+				continue
+			}
+			schedule(name)
+
+		case <-quiet.C:
+			ready, unsettled := s.settled(pending, seen)
+			if len(ready) > 0 {
+				err := s.updateAll(ready)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+			}
+			pending = unsettled
+			if len(pending) > 0 {
+				wait := s.settle
+				if wait < s.batch {
+					wait = s.batch
+				}
+				quiet.Reset(wait)
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok { return nil }
+			return err
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkScan scans a secret/ of large files already encrypted, summing each file
+// again and trusting the size and mtime the digest has under -trust-mtime
+func BenchmarkScan(b *testing.B) {
+	for _, trust := range []bool{false, true} {
+		name := "summed"
+		if trust {
+			name = "trust-mtime"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestServ(b)
+			s.trustMtime = trust
+			const files, size = 8, 4 << 20
+			for i := 0; i < files; i++ {
+				writeSecret(b, fmt.Sprintf("f%d", i), noise(size+i))
+			}
+			err := s.scan(context.Background())
+			if err != nil { b.Fatal(err) }
+			b.SetBytes(files * size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := s.scan(context.Background())
+				if err != nil { b.Fatal(err) }
+			}
+		})
+	}
+}